@@ -0,0 +1,431 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "log/slog"
+  "net/http"
+  "slices"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// API keys let integrations, such as a dealer's DMS, act on behalf of their
+// user without signing in. A key only reaches the routes that ask for one
+// of its scopes.
+const (
+  ScopeMotorcyclesRead  = "motorcycles:read"
+  ScopeMotorcyclesWrite = "motorcycles:write"
+  ScopeWebhooksRead     = "webhooks:read"
+  ScopeWebhooksWrite    = "webhooks:write"
+)
+
+var apiKeyScopes = map[string]bool{
+  ScopeMotorcyclesRead:  true,
+  ScopeMotorcyclesWrite: true,
+  ScopeWebhooksRead:     true,
+  ScopeWebhooksWrite:    true,
+}
+
+const (
+  // apiKeyPrefix marks a string as one of our keys, so that leaked keys are
+  // easy to spot and to scan for.
+  apiKeyPrefix = "mk_"
+
+  // apiKeyPrefixLength is how much of a key is kept in the clear, enough
+  // for its user to tell it apart from the others.
+  apiKeyPrefixLength = len(apiKeyPrefix) + 8
+
+  apiKeyNameMaxLength = 64
+
+  // apiKeyTouchInterval is how stale last_used_at may get before a request
+  // updates it.
+  apiKeyTouchInterval = time.Minute
+)
+
+var (
+  ErrInvalidAPIKey         = newError(ErrUnauthenticated, "invalid_api_key", "invalid api key")
+  ErrInvalidAPIKeyCreation = newError(ErrInvalidInput, "invalid_api_key_creation", "invalid api key creation")
+  ErrAPIKeyNotFound        = newError(ErrNotFound, "api_key_not_found", "api key not found")
+)
+
+type APIKey struct {
+  ID         int      `json:"id"`
+  Name       string   `json:"name"`
+  Key        string   `json:"key,omitempty"`
+  Prefix     string   `json:"prefix"`
+  Scopes     []string `json:"scopes"`
+  LastUsedAt *string  `json:"last_used_at"`
+  CreatedAt  string   `json:"created_at"`
+}
+
+type APIKeyCreation struct {
+  Name   string   `json:"name"`
+  Scopes []string `json:"scopes"`
+}
+
+// hasScope tells whether granted allows scope. Writing implies reading.
+func hasScope(granted []string, scope string) bool {
+  if slices.Contains(granted, scope) {
+    return true
+  }
+
+  resource, access, _ := strings.Cut(scope, ":")
+
+  return "read" == access && slices.Contains(granted, resource+":write")
+}
+
+const apiKeySnapshotQuery = `
+  SELECT id,
+         name,
+         prefix,
+         scopes,
+         revoked_at
+    FROM api_key
+   WHERE id = @id;`
+
+type APIKeyService struct {
+  db    *sql.DB
+  audit *AuditService
+}
+
+func NewAPIKeyService(db *sql.DB, audit *AuditService) *APIKeyService {
+  return &APIKeyService{db, audit}
+}
+
+// Create makes a key for userID. The key itself is returned only here; what
+// is stored is its hash.
+func (s *APIKeyService) Create(ctx context.Context, userID int, creation *APIKeyCreation) (key *APIKey, err error) {
+  name := strings.TrimSpace(creation.Name)
+  if "" == name || apiKeyNameMaxLength < len(name) {
+    return nil, ErrInvalidAPIKeyCreation
+  }
+
+  if 0 == len(creation.Scopes) {
+    return nil, ErrInvalidAPIKeyCreation
+  }
+
+  for _, scope := range creation.Scopes {
+    if !apiKeyScopes[scope] {
+      return nil, ErrInvalidAPIKeyCreation
+    }
+  }
+
+  scopes := slices.Clone(creation.Scopes)
+  slices.Sort(scopes)
+  scopes = slices.Compact(scopes)
+
+  createAPIKeyQuery := `
+  INSERT INTO api_key (user_id, name, prefix, key_hash, scopes)
+               VALUES (@user_id, @name, @prefix, @key_hash, @scopes)
+    RETURNING id, created_at;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  secret := apiKeyPrefix + randomHex(24)
+
+  key = &APIKey{
+    Name:   name,
+    Key:    secret,
+    Prefix: secret[:apiKeyPrefixLength],
+    Scopes: scopes,
+  }
+
+  err = tx.QueryRowContext(ctx, createAPIKeyQuery,
+    sql.Named("user_id", userID),
+    sql.Named("name", key.Name),
+    sql.Named("prefix", key.Prefix),
+    sql.Named("key_hash", hashToken(secret)),
+    sql.Named("scopes", strings.Join(scopes, ","))).
+    Scan(&key.ID, &key.CreatedAt)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  after, err := snapshot(ctx, tx, apiKeySnapshotQuery, sql.Named("id", key.ID))
+  if nil != err {
+    return nil, err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionCreate, "api_key", key.ID, nil, after)
+  if nil != err {
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return key, nil
+}
+
+// Get lists the keys of userID that have not been revoked.
+func (s *APIKeyService) Get(ctx context.Context, userID int) (keys []*APIKey, err error) {
+  getAPIKeysQuery := `
+  SELECT id,
+         name,
+         prefix,
+         scopes,
+         last_used_at,
+         created_at
+    FROM api_key
+   WHERE user_id = $1
+     AND revoked_at IS NULL
+ORDER BY id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  result, err := s.db.QueryContext(ctx, getAPIKeysQuery, userID)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  keys = make([]*APIKey, 0)
+
+  for result.Next() {
+    var (
+      key    APIKey
+      scopes string
+    )
+
+    err = result.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.LastUsedAt, &key.CreatedAt)
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    key.Scopes = strings.Split(scopes, ",")
+    keys = append(keys, &key)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return keys, nil
+}
+
+// Revoke stops keyID from authenticating. Revoked keys are kept, so that
+// the audit log still makes sense.
+func (s *APIKeyService) Revoke(ctx context.Context, userID, keyID int) error {
+  revokeAPIKeyQuery := `
+  UPDATE api_key
+     SET revoked_at = @now
+   WHERE id = @id
+     AND user_id = @user_id
+     AND revoked_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  before, err := snapshot(ctx, tx, apiKeySnapshotQuery, sql.Named("id", keyID))
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrAPIKeyNotFound
+    }
+
+    return err
+  }
+
+  result, err := tx.ExecContext(ctx, revokeAPIKeyQuery,
+    sql.Named("now", time.Now().UTC().Format(time.DateTime)),
+    sql.Named("id", keyID),
+    sql.Named("user_id", userID))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  revoked, err := result.RowsAffected()
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if 0 == revoked {
+    return ErrAPIKeyNotFound
+  }
+
+  after, err := snapshot(ctx, tx, apiKeySnapshotQuery, sql.Named("id", keyID))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionDelete, "api_key", keyID, before, after)
+  if nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Authenticate finds the active key matching secret and returns the
+// principal it authenticates: its user, limited to its scopes.
+func (s *APIKeyService) Authenticate(ctx context.Context, secret string) (*Principal, error) {
+  if !strings.HasPrefix(secret, apiKeyPrefix) {
+    return nil, ErrInvalidAPIKey
+  }
+
+  getAPIKeyQuery := `
+  SELECT k.id,
+         k.user_id,
+         k.scopes,
+         u.role
+    FROM api_key k
+    JOIN "user" u
+      ON u.id = k.user_id
+   WHERE k.key_hash = $1
+     AND k.revoked_at IS NULL
+     AND u.deleted_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  var (
+    principal = Principal{Method: AuthMethodAPIKey}
+    scopes    string
+    role      string
+  )
+
+  err := s.db.QueryRowContext(ctx, getAPIKeyQuery, hashToken(secret)).Scan(&principal.APIKeyID, &principal.UserID, &scopes, &role)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrInvalidAPIKey
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  s.touch(ctx, principal.APIKeyID)
+
+  principal.Roles = []string{role}
+  principal.Scopes = strings.Split(scopes, ",")
+
+  return &principal, nil
+}
+
+// touch records that keyID was just used. Failing to do so must not fail
+// the request, so errors are only logged.
+func (s *APIKeyService) touch(ctx context.Context, keyID int) {
+  touchAPIKeyQuery := `
+  UPDATE api_key
+     SET last_used_at = current_timestamp
+   WHERE id = @id
+     AND (last_used_at IS NULL OR last_used_at < @stale);`
+
+  _, err := s.db.ExecContext(ctx, touchAPIKeyQuery,
+    sql.Named("id", keyID),
+    sql.Named("stale", time.Now().UTC().Add(-apiKeyTouchInterval).Format(time.DateTime)))
+  if nil != err {
+    slog.Error(err.Error())
+  }
+}
+
+type APIKeyHandler struct {
+  s *APIKeyService
+}
+
+func NewAPIKeyHandler(service *APIKeyService) *APIKeyHandler {
+  return &APIKeyHandler{service}
+}
+
+func (h *APIKeyHandler) Create(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  creation := APIKeyCreation{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&creation)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  key, err := h.s.Create(r.Context(), userID, &creation)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(key)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusCreated)
+  w.Write(response)
+}
+
+func (h *APIKeyHandler) Get(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  keys, err := h.s.Get(r.Context(), userID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(keys)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *APIKeyHandler) Delete(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  keyID, err := strconv.Atoi(r.PathValue("api_key_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  err = h.s.Revoke(r.Context(), userID, keyID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "reflect"
+  "strconv"
+  "time"
+)
+
+const (
+  AuditActionCreate  = "create"
+  AuditActionUpdate  = "update"
+  AuditActionDelete  = "delete"
+  AuditActionRestore = "restore"
+)
+
+// auditRedactedFields are recorded as changed without their values.
+var auditRedactedFields = map[string]bool{
+  "password": true,
+}
+
+type FieldChange struct {
+  Before any `json:"before"`
+  After  any `json:"after"`
+}
+
+type AuditEntry struct {
+  ID         int                     `json:"id"`
+  ActorID    *int                    `json:"actor_id"`
+  Action     string                  `json:"action"`
+  EntityType string                  `json:"entity_type"`
+  EntityID   int                     `json:"entity_id"`
+  Changes    map[string]*FieldChange `json:"changes"`
+  RequestID  *string                 `json:"request_id"`
+  IP         *string                 `json:"ip"`
+  CreatedAt  string                  `json:"created_at"`
+}
+
+type AuditFilter struct {
+  EntityType string
+  EntityID   int
+  ActorID    int
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+  ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+  QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+  QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// snapshot reads the single row selected by query into a column → value
+// map, which is what audit entries diff.
+func snapshot(ctx context.Context, q querier, query string, args ...any) (map[string]any, error) {
+  result, err := q.QueryContext(ctx, query, args...)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  if !result.Next() {
+    if err = result.Err(); nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    return nil, sql.ErrNoRows
+  }
+
+  columns, err := result.Columns()
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  values := make([]any, len(columns))
+  pointers := make([]any, len(columns))
+  for i := range values {
+    pointers[i] = &values[i]
+  }
+
+  if err = result.Scan(pointers...); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  row := make(map[string]any, len(columns))
+  for i, column := range columns {
+    if b, ok := values[i].([]byte); ok {
+      values[i] = string(b)
+    }
+
+    row[column] = values[i]
+  }
+
+  return row, nil
+}
+
+// diff returns the fields whose value differs between before and after;
+// either side may be nil for creations and deletions.
+func diff(before, after map[string]any) map[string]*FieldChange {
+  changes := map[string]*FieldChange{}
+
+  for field, value := range after {
+    if previous, ok := before[field]; (!ok && nil != value) || (ok && !reflect.DeepEqual(previous, value)) {
+      changes[field] = &FieldChange{Before: before[field], After: value}
+    }
+  }
+
+  for field, value := range before {
+    if _, ok := after[field]; !ok && nil != value {
+      changes[field] = &FieldChange{Before: value}
+    }
+  }
+
+  for field, change := range changes {
+    if auditRedactedFields[field] {
+      change.Before, change.After = nil, nil
+    }
+  }
+
+  return changes
+}
+
+type AuditService struct {
+  db *sql.DB
+}
+
+func NewAuditService(db *sql.DB) *AuditService {
+  return &AuditService{db}
+}
+
+// Record writes an audit entry in tx, so that it is committed or rolled
+// back together with the change it describes.
+func (s *AuditService) Record(ctx context.Context, tx *sql.Tx, action, entityType string, entityID int, before, after map[string]any) error {
+  recordQuery := `
+  INSERT INTO audit_log (actor_id, action, entity_type, entity_id, changes, request_id, ip)
+                 VALUES (@actor_id, @action, @entity_type, @entity_id, @changes, @request_id, @ip);`
+
+  changes, err := json.Marshal(diff(before, after))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  var actorID, requestID, ip any
+
+  // Unauthenticated changes to an account, such as signing up or
+  // restoring it, can only have been made by its owner.
+  if principal := principalFrom(ctx); nil != principal {
+    actorID = principal.UserID
+  } else if "user" == entityType {
+    actorID = entityID
+  }
+
+  if metadata, ok := requestMetadataFrom(ctx); ok {
+    requestID, ip = metadata.ID, metadata.IP
+  }
+
+  _, err = tx.ExecContext(ctx, recordQuery,
+    sql.Named("actor_id", actorID),
+    sql.Named("action", action),
+    sql.Named("entity_type", entityType),
+    sql.Named("entity_id", entityID),
+    sql.Named("changes", string(changes)),
+    sql.Named("request_id", requestID),
+    sql.Named("ip", ip))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+func (s *AuditService) Get(ctx context.Context, filter *AuditFilter, page int) (entries []*AuditEntry, err error) {
+  getAuditEntriesQuery := `
+  SELECT id,
+         actor_id,
+         action,
+         entity_type,
+         entity_id,
+         changes,
+         request_id,
+         ip,
+         created_at
+    FROM audit_log
+   WHERE (@entity_type = '' OR entity_type = @entity_type)
+     AND (0 = @entity_id OR entity_id = @entity_id)
+     AND (0 = @actor_id OR actor_id = @actor_id)
+ORDER BY id DESC
+   LIMIT 50
+   OFFSET 50 * (@page - 1);`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  if 0 >= page {
+    page = 1
+  }
+
+  result, err := s.db.QueryContext(ctx, getAuditEntriesQuery,
+    sql.Named("entity_type", filter.EntityType),
+    sql.Named("entity_id", filter.EntityID),
+    sql.Named("actor_id", filter.ActorID),
+    sql.Named("page", page))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  entries = make([]*AuditEntry, 0)
+
+  for result.Next() {
+    var (
+      entry   AuditEntry
+      changes string
+    )
+
+    err = result.Scan(
+      &entry.ID,
+      &entry.ActorID,
+      &entry.Action,
+      &entry.EntityType,
+      &entry.EntityID,
+      &changes,
+      &entry.RequestID,
+      &entry.IP,
+      &entry.CreatedAt,
+    )
+
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    if err = json.Unmarshal([]byte(changes), &entry.Changes); nil != err {
+      slog.Error(fmt.Sprintf("audit entry %d: %v", entry.ID, err))
+      return nil, err
+    }
+
+    entries = append(entries, &entry)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return entries, nil
+}
+
+type AuditHandler struct {
+  s *AuditService
+}
+
+func NewAuditHandler(service *AuditService) *AuditHandler {
+  return &AuditHandler{service}
+}
+
+func (h *AuditHandler) Get(w http.ResponseWriter, r *http.Request) {
+  query := r.URL.Query()
+  filter := &AuditFilter{EntityType: query.Get("entity_type")}
+
+  var (
+    page = 1
+    err  error
+  )
+
+  for key, target := range map[string]*int{"entity_id": &filter.EntityID, "actor_id": &filter.ActorID, "page": &page} {
+    if value := query.Get(key); "" != value {
+      if *target, err = strconv.Atoi(value); nil != err {
+        slog.Error(err.Error())
+        writeError(w, r, ErrInvalidQuery)
+        return
+      }
+    }
+  }
+
+  entries, err := h.s.Get(r.Context(), filter, page)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(entries)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
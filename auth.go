@@ -0,0 +1,221 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/golang-jwt/jwt/v5"
+  "log/slog"
+  "net/http"
+  "slices"
+  "strings"
+)
+
+const authRealm = "access to system"
+
+type AuthMethod string
+
+const (
+  AuthMethodSession AuthMethod = "session"
+  AuthMethodAPIKey  AuthMethod = "api_key"
+)
+
+// Principal is who a request is authenticated as. SessionID is only set
+// for access tokens, and APIKeyID and Scopes only for API keys.
+type Principal struct {
+  UserID    int
+  Roles     []string
+  SessionID int
+  APIKeyID  int
+  Scopes    []string
+  Method    AuthMethod
+}
+
+func (p *Principal) HasRole(role string) bool {
+  return slices.Contains(p.Roles, role)
+}
+
+type principalContextKey struct{}
+
+// principalFrom returns who the request behind ctx is authenticated as, or
+// nil for anonymous requests.
+func principalFrom(ctx context.Context) *Principal {
+  principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+  return principal
+}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+  return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// AuthenticationError is why credentials were rejected, reported back in
+// the WWW-Authenticate header as RFC 6750 describes.
+type AuthenticationError struct {
+  Code        string
+  Description string
+}
+
+func (e *AuthenticationError) Error() string {
+  return e.Code + ": " + e.Description
+}
+
+// tokenErrorDescription explains why an access token did not verify.
+func tokenErrorDescription(err error) string {
+  switch {
+  case errors.Is(err, jwt.ErrTokenExpired):
+    return "The access token expired"
+  case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+    return "The access token is not valid yet"
+  case errors.Is(err, jwt.ErrTokenMalformed):
+    return "The access token is malformed"
+  case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+    return "The access token signature is invalid"
+  default:
+    return "The access token is invalid"
+  }
+}
+
+// Authenticator authenticates requests with a bearer access token or with
+// an API key in the X-API-Key header.
+type Authenticator struct {
+  sessions *SessionService
+  apiKeys  *APIKeyService
+}
+
+func NewAuthenticator(sessions *SessionService, apiKeys *APIKeyService) *Authenticator {
+  return &Authenticator{sessions, apiKeys}
+}
+
+// authenticate returns the principal r is authenticated as, or nil when it
+// carries no credentials. Rejected credentials are an *AuthenticationError.
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, error) {
+  if secret := r.Header.Get("X-API-Key"); "" != secret {
+    principal, err := a.apiKeys.Authenticate(r.Context(), secret)
+    if nil != err {
+      if errors.Is(err, ErrInvalidAPIKey) {
+        return nil, &AuthenticationError{"invalid_token", "The API key is invalid or revoked"}
+      }
+
+      return nil, err
+    }
+
+    return principal, nil
+  }
+
+  authorization := r.Header.Get("Authorization")
+  if "" == authorization {
+    return nil, nil
+  }
+
+  scheme, token, _ := strings.Cut(authorization, " ")
+  if !strings.EqualFold("Bearer", scheme) || "" == strings.TrimSpace(token) {
+    return nil, &AuthenticationError{"invalid_request", "The Authorization header must be \"Bearer <token>\""}
+  }
+
+  claims, err := a.sessions.keys.Parse(strings.TrimSpace(token), "authentication")
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, &AuthenticationError{"invalid_token", tokenErrorDescription(err)}
+  }
+
+  userID, userOK := claims["user_id"].(float64)
+  sessionID, sessionOK := claims["sid"].(float64)
+  if !userOK || !sessionOK {
+    return nil, &AuthenticationError{"invalid_token", "The access token is invalid"}
+  }
+
+  principal, err := a.sessions.Validate(r.Context(), int(userID), int(sessionID))
+  if nil != err {
+    if errors.Is(err, ErrSessionRevoked) {
+      return nil, &AuthenticationError{"invalid_token", "The session has been signed out"}
+    }
+
+    return nil, err
+  }
+
+  return principal, nil
+}
+
+// challenge answers 401 to requests without credentials, telling the
+// client how to authenticate. Rejected credentials are answered by
+// writeError, which says what was wrong with them.
+func challenge(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
+  writeProblem(w, r, http.StatusUnauthorized, "unauthenticated", "authentication is required")
+}
+
+// authorize tells whether principal may call a route open to API keys
+// holding one of scopes. Access tokens may call any route.
+func authorize(principal *Principal, scopes []string) bool {
+  if AuthMethodAPIKey != principal.Method {
+    return true
+  }
+
+  for _, scope := range scopes {
+    if hasScope(principal.Scopes, scope) {
+      return true
+    }
+  }
+
+  return false
+}
+
+func (a *Authenticator) wrap(required bool, next http.HandlerFunc, scopes []string) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    principal, err := a.authenticate(r)
+    if nil != err {
+      writeError(w, r, err)
+      return
+    }
+
+    if nil == principal {
+      if required {
+        challenge(w, r)
+        return
+      }
+
+      next.ServeHTTP(w, r)
+      return
+    }
+
+    if !authorize(principal, scopes) {
+      value := fmt.Sprintf("Bearer realm=%q, error=\"insufficient_scope\"", authRealm)
+      if 0 < len(scopes) {
+        value += fmt.Sprintf(", scope=%q", strings.Join(scopes, " "))
+      }
+
+      w.Header().Set("WWW-Authenticate", value)
+      writeProblem(w, r, http.StatusForbidden, "insufficient_scope", "the API key lacks the scope this route needs")
+      return
+    }
+
+    next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+  }
+}
+
+// Require only lets authenticated requests through to next. API keys only
+// get through when given scopes, and when they hold one of them.
+func (a *Authenticator) Require(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+  return a.wrap(true, next, scopes)
+}
+
+// Optional lets anonymous requests through as well, for public routes that
+// personalise their results for whoever is signed in. Credentials that are
+// sent must still be valid.
+func (a *Authenticator) Optional(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+  return a.wrap(false, next, scopes)
+}
+
+// withRole only lets principals with role through; it must go inside the
+// authorization middleware.
+func withRole(role string, next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    principal := principalFrom(r.Context())
+    if nil == principal || !principal.HasRole(role) {
+      writeProblem(w, r, http.StatusForbidden, "forbidden", "the "+role+" role is required")
+      return
+    }
+
+    next.ServeHTTP(w, r)
+  }
+}
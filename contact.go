@@ -0,0 +1,208 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// contactRevealWindow is the period the reveal quota applies to.
+const contactRevealWindow = 24 * time.Hour
+
+var (
+  ErrContactNotShared = newError(ErrForbidden, "contact_not_shared", "the seller does not share their contact details")
+)
+
+// ContactRevealQuotaError is returned when a user has revealed the contact
+// details of as many listings as they may within a day.
+type ContactRevealQuotaError struct {
+  RetryAfter time.Duration
+}
+
+func (e *ContactRevealQuotaError) Error() string {
+  return fmt.Sprintf("daily contact reveal quota reached, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *ContactRevealQuotaError) code() string {
+  return "contact_reveal_quota_exceeded"
+}
+
+func (e *ContactRevealQuotaError) retryAfter() time.Duration {
+  return e.RetryAfter
+}
+
+// ContactRevealService hands out the contact details of sellers, which
+// listings hide unless the seller chose otherwise and which sellers can opt
+// out of revealing. Every reveal is recorded, for the seller to see how many
+// buyers got in touch and to cap how many sellers a single account can
+// harvest a day.
+type ContactRevealService struct {
+  db         *sql.DB
+  dailyQuota int
+}
+
+func NewContactRevealService(db *sql.DB, dailyQuota int) *ContactRevealService {
+  return &ContactRevealService{db, dailyQuota}
+}
+
+// Reveal returns the contact details of the seller of motorcycleID to
+// userID, leaving out those the seller opted out of revealing.
+// Revealing the same listing again within the window, or one's own listing,
+// is not recorded and does not count against the quota.
+func (s *ContactRevealService) Reveal(ctx context.Context, userID, motorcycleID int) (*ListingContact, error) {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  getContactQuery := `
+  SELECT m.owner_id,
+         u.phone_number,
+         u.email,
+         u.reveal_phone,
+         u.reveal_email
+    FROM motorcycle m
+    JOIN "user" u
+      ON u.id = m.owner_id
+   WHERE m.id = $1
+     AND m.status = 'active'
+     AND m.deleted_at IS NULL
+     AND u.deleted_at IS NULL;`
+
+  getRevealsQuery := `
+  SELECT count(*),
+         coalesce(min(created_at), ''),
+         coalesce(max(motorcycle_id = @motorcycle_id), 0)
+    FROM contact_reveal
+   WHERE user_id = @user_id
+     AND created_at > @since;`
+
+  insertRevealQuery := `
+  INSERT INTO contact_reveal (motorcycle_id, user_id)
+       VALUES (@motorcycle_id, @user_id);`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    ownerID                int
+    contact                ListingContact
+    sharePhone, shareEmail bool
+  )
+
+  err = tx.QueryRowContext(ctx, getContactQuery, motorcycleID).Scan(&ownerID, &contact.PhoneNumber, &contact.Email, &sharePhone, &shareEmail)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrMotorcycleNotFound
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if userID == ownerID {
+    return &contact, nil
+  }
+
+  if !sharePhone {
+    contact.PhoneNumber = ""
+  }
+
+  if !shareEmail {
+    contact.Email = ""
+  }
+
+  // The seller opted out of both, so there is no reveal to record either.
+  if "" == contact.PhoneNumber && "" == contact.Email {
+    return nil, ErrContactNotShared
+  }
+
+  var (
+    reveals  int
+    oldest   string
+    revealed bool
+  )
+
+  now := time.Now().UTC()
+
+  err = tx.QueryRowContext(ctx, getRevealsQuery,
+    sql.Named("user_id", userID),
+    sql.Named("motorcycle_id", motorcycleID),
+    sql.Named("since", now.Add(-contactRevealWindow).Format(time.DateTime))).
+    Scan(&reveals, &oldest, &revealed)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if revealed {
+    return &contact, nil
+  }
+
+  if s.dailyQuota <= reveals {
+    oldestAt, err := time.Parse(time.DateTime, oldest)
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    return nil, &ContactRevealQuotaError{RetryAfter: oldestAt.Add(contactRevealWindow).Sub(now)}
+  }
+
+  _, err = tx.ExecContext(ctx, insertRevealQuery, sql.Named("motorcycle_id", motorcycleID), sql.Named("user_id", userID))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return &contact, nil
+}
+
+type ContactRevealHandler struct {
+  s *ContactRevealService
+}
+
+func NewContactRevealHandler(service *ContactRevealService) *ContactRevealHandler {
+  return &ContactRevealHandler{service}
+}
+
+func (h *ContactRevealHandler) Create(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  motorcycleID, err := strconv.Atoi(r.PathValue("motorcycle_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  contact, err := h.s.Reveal(r.Context(), userID, motorcycleID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(contact)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
@@ -1,16 +1,26 @@
+PRAGMA user_version = 17;
+
 CREATE TABLE IF NOT EXISTS "user"
 (
-  "id"           INTEGER            NOT NULL PRIMARY KEY AUTOINCREMENT,
-  "first_name"   VARCHAR(64)        NOT NULL,
-  "middle_name"  VARCHAR(64)                 DEFAULT NULL,
-  "last_name"    VARCHAR(64)                 DEFAULT NULL,
-  "surname"      VARCHAR(64)                 DEFAULT NULL,
-  "email"        VARCHAR(240)       NOT NULL UNIQUE,
-  "phone_number" VARCHAR(64) UNIQUE NOT NULL,
-  "picture_url"  VARCHAR(2048)               DEFAULT NULL,
-  "password"     VARCHAR(256)       NOT NULL,
-  "created_at"   timestamptz        NOT NULL DEFAULT current_timestamp,
-  "updated_at"   timestamptz        NOT NULL DEFAULT current_timestamp
+  "id"                     INTEGER            NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "first_name"             VARCHAR(64)        NOT NULL,
+  "middle_name"            VARCHAR(64)                 DEFAULT NULL,
+  "last_name"              VARCHAR(64)                 DEFAULT NULL,
+  "surname"                VARCHAR(64)                 DEFAULT NULL,
+  "email"                  VARCHAR(240)       NOT NULL UNIQUE,
+  "phone_number"           VARCHAR(64) UNIQUE NOT NULL,
+  "picture_url"            VARCHAR(2048)               DEFAULT NULL,
+  "password"               VARCHAR(256)       NOT NULL,
+  "role"                   VARCHAR(16)        NOT NULL DEFAULT 'user',
+  "locale"                 VARCHAR(8)         NOT NULL DEFAULT 'en',
+  "show_phone_on_listings" BOOLEAN            NOT NULL DEFAULT 0,
+  "show_email_on_listings" BOOLEAN            NOT NULL DEFAULT 0,
+  "reveal_phone"           BOOLEAN            NOT NULL DEFAULT 1,
+  "reveal_email"           BOOLEAN            NOT NULL DEFAULT 1,
+  "email_verified_at"      timestamptz                 DEFAULT NULL,
+  "created_at"             timestamptz        NOT NULL DEFAULT current_timestamp,
+  "updated_at"             timestamptz        NOT NULL DEFAULT current_timestamp,
+  "deleted_at"             timestamptz                 DEFAULT NULL
 );
 
 
@@ -29,8 +39,13 @@ CREATE TABLE IF NOT EXISTS "motorcycle"
   "color"       VARCHAR(32)  NOT NULL,
   "description" VARCHAR(512) NOT NULL DEFAULT 'No description',
   "location"    VARCHAR(512) NOT NULL DEFAULT 'Unknown',
+  "status"      VARCHAR(16)  NOT NULL DEFAULT 'active',
+  "renewed_at"  timestamptz  NOT NULL DEFAULT current_timestamp,
+  "expires_at"  timestamptz           DEFAULT NULL,
+  "reminded_at" timestamptz           DEFAULT NULL,
   "created_at"  timestamptz  NOT NULL DEFAULT current_timestamp,
-  "updated_at"  timestamptz  NOT NULL DEFAULT current_timestamp
+  "updated_at"  timestamptz  NOT NULL DEFAULT current_timestamp,
+  "deleted_at"  timestamptz           DEFAULT NULL
 );
 
 CREATE TABLE IF NOT EXISTS "motorcycle_image"
@@ -47,3 +62,200 @@ CREATE TABLE IF NOT EXISTS "favorite"
   "user_id"       INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
   "motorcycle_id" INTEGER NOT NULL REFERENCES "motorcycle" ("id") ON DELETE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS "audit_log"
+(
+  "id"          INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "actor_id"    INTEGER              DEFAULT NULL,
+  "action"      VARCHAR(32) NOT NULL,
+  "entity_type" VARCHAR(32) NOT NULL,
+  "entity_id"   INTEGER     NOT NULL,
+  "changes"     TEXT        NOT NULL DEFAULT '{}',
+  "request_id"  VARCHAR(64)          DEFAULT NULL,
+  "ip"          VARCHAR(64)          DEFAULT NULL,
+  "created_at"  timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "audit_log_entity_idx" ON "audit_log" ("entity_type", "entity_id");
+CREATE INDEX IF NOT EXISTS "audit_log_actor_idx" ON "audit_log" ("actor_id");
+
+CREATE TABLE IF NOT EXISTS "webhook_subscription"
+(
+  "id"          INTEGER       NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"     INTEGER       NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "url"         VARCHAR(2048) NOT NULL,
+  "secret"      VARCHAR(128)  NOT NULL,
+  "event_types" VARCHAR(512)  NOT NULL,
+  "created_at"  timestamptz   NOT NULL DEFAULT current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS "webhook_delivery"
+(
+  "id"               INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "subscription_id"  INTEGER     NOT NULL REFERENCES "webhook_subscription" ("id") ON DELETE CASCADE,
+  "event_id"         VARCHAR(64) NOT NULL,
+  "event_type"       VARCHAR(64) NOT NULL,
+  "payload"          TEXT        NOT NULL,
+  "status"           VARCHAR(16) NOT NULL DEFAULT 'pending',
+  "attempts"         INTEGER     NOT NULL DEFAULT 0,
+  "next_attempt_at"  timestamptz NOT NULL DEFAULT current_timestamp,
+  "last_status_code" INTEGER              DEFAULT NULL,
+  "last_error"       TEXT                 DEFAULT NULL,
+  "created_at"       timestamptz NOT NULL DEFAULT current_timestamp,
+  "delivered_at"     timestamptz          DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "webhook_delivery_due_idx" ON "webhook_delivery" ("status", "next_attempt_at");
+
+CREATE TABLE IF NOT EXISTS "notification"
+(
+  "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"    INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "type"       VARCHAR(64) NOT NULL,
+  "data"       TEXT        NOT NULL DEFAULT '{}',
+  "read_at"    timestamptz          DEFAULT NULL,
+  "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "notification_user_idx" ON "notification" ("user_id", "read_at");
+
+CREATE TABLE IF NOT EXISTS "email_outbox"
+(
+  "id"              INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "recipient"       VARCHAR(255) NOT NULL,
+  "template"        VARCHAR(64)  NOT NULL,
+  "locale"          VARCHAR(8)   NOT NULL,
+  "subject"         TEXT         NOT NULL,
+  "text_body"       TEXT                  DEFAULT NULL,
+  "html_body"       TEXT                  DEFAULT NULL,
+  "status"          VARCHAR(16)  NOT NULL DEFAULT 'pending',
+  "attempts"        INTEGER      NOT NULL DEFAULT 0,
+  "next_attempt_at" timestamptz  NOT NULL DEFAULT current_timestamp,
+  "last_error"      TEXT                  DEFAULT NULL,
+  "created_at"      timestamptz  NOT NULL DEFAULT current_timestamp,
+  "sent_at"         timestamptz           DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "email_outbox_due_idx" ON "email_outbox" ("status", "next_attempt_at");
+
+CREATE TABLE IF NOT EXISTS "email_verification"
+(
+  "id"         INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"    INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "email"      VARCHAR(240) NOT NULL,
+  "token_hash" VARCHAR(64)  NOT NULL,
+  "expires_at" timestamptz  NOT NULL,
+  "used_at"    timestamptz           DEFAULT NULL,
+  "created_at" timestamptz  NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "email_verification_user_idx" ON "email_verification" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "password_reset"
+(
+  "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"    INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "token_hash" VARCHAR(64) NOT NULL UNIQUE,
+  "expires_at" timestamptz NOT NULL,
+  "used_at"    timestamptz          DEFAULT NULL,
+  "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "password_reset_user_idx" ON "password_reset" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "session"
+(
+  "id"           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"      INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "device_name"  VARCHAR(64)           DEFAULT NULL,
+  "user_agent"   VARCHAR(256)          DEFAULT NULL,
+  "ip"           VARCHAR(45)           DEFAULT NULL,
+  "expires_at"   timestamptz  NOT NULL,
+  "revoked_at"   timestamptz           DEFAULT NULL,
+  "created_at"   timestamptz  NOT NULL DEFAULT current_timestamp,
+  "last_seen_at" timestamptz  NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "session_user_idx" ON "session" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "refresh_token"
+(
+  "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "session_id" INTEGER     NOT NULL REFERENCES "session" ("id") ON DELETE CASCADE,
+  "token_hash" VARCHAR(64) NOT NULL UNIQUE,
+  "used_at"    timestamptz          DEFAULT NULL,
+  "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "refresh_token_session_idx" ON "refresh_token" ("session_id");
+
+CREATE TABLE IF NOT EXISTS "login_throttle"
+(
+  "scope"           VARCHAR(8)   NOT NULL,
+  "key"             VARCHAR(240) NOT NULL,
+  "failures"        INTEGER      NOT NULL DEFAULT 0,
+  "last_failure_at" timestamptz  NOT NULL,
+  "locked_until"    timestamptz           DEFAULT NULL,
+  PRIMARY KEY ("scope", "key")
+);
+
+CREATE TABLE IF NOT EXISTS "totp"
+(
+  "user_id"        INTEGER      NOT NULL PRIMARY KEY REFERENCES "user" ("id") ON DELETE CASCADE,
+  "secret"         VARCHAR(128) NOT NULL,
+  "last_used_step" INTEGER      NOT NULL DEFAULT 0,
+  "confirmed_at"   timestamptz           DEFAULT NULL,
+  "created_at"     timestamptz  NOT NULL DEFAULT current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS "recovery_code"
+(
+  "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"    INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "code_hash"  VARCHAR(64) NOT NULL,
+  "used_at"    timestamptz          DEFAULT NULL,
+  "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "recovery_code_user_idx" ON "recovery_code" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "api_key"
+(
+  "id"           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"      INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "name"         VARCHAR(64)  NOT NULL,
+  "prefix"       VARCHAR(16)  NOT NULL,
+  "key_hash"     VARCHAR(64)  NOT NULL UNIQUE,
+  "scopes"       VARCHAR(512) NOT NULL,
+  "last_used_at" timestamptz           DEFAULT NULL,
+  "created_at"   timestamptz  NOT NULL DEFAULT current_timestamp,
+  "revoked_at"   timestamptz           DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "api_key_user_idx" ON "api_key" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "contact_reveal"
+(
+  "id"            INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "motorcycle_id" INTEGER     NOT NULL REFERENCES "motorcycle" ("id") ON DELETE CASCADE,
+  "user_id"       INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "created_at"    timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS "contact_reveal_user_idx" ON "contact_reveal" ("user_id", "created_at");
+CREATE INDEX IF NOT EXISTS "contact_reveal_motorcycle_idx" ON "contact_reveal" ("motorcycle_id");
+
+CREATE TABLE IF NOT EXISTS "data_export"
+(
+  "id"           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+  "user_id"      INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+  "status"       VARCHAR(16)  NOT NULL DEFAULT 'pending',
+  "path"         VARCHAR(512)          DEFAULT NULL,
+  "size"         INTEGER               DEFAULT NULL,
+  "created_at"   timestamptz  NOT NULL DEFAULT current_timestamp,
+  "completed_at" timestamptz           DEFAULT NULL,
+  "expires_at"   timestamptz           DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "data_export_user_idx" ON "data_export" ("user_id");
+CREATE INDEX IF NOT EXISTS "data_export_status_idx" ON "data_export" ("status");
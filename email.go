@@ -0,0 +1,403 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "database/sql"
+  "embed"
+  "fmt"
+  htmltemplate "html/template"
+  "io/fs"
+  "log/slog"
+  "mime"
+  "mime/multipart"
+  "mime/quotedprintable"
+  "net"
+  "net/smtp"
+  "net/textproto"
+  "os"
+  "path/filepath"
+  "strings"
+  texttemplate "text/template"
+  "time"
+)
+
+const (
+  EmailPending = "pending"
+  EmailSent    = "sent"
+  EmailFailed  = "failed"
+)
+
+const (
+  // emailMaxAttempts is how many times an email is tried before it is
+  // marked as failed.
+  emailMaxAttempts = 8
+
+  emailBaseBackoff = time.Minute
+  emailMaxBackoff  = 12 * time.Hour
+
+  // emailBatchSize bounds the emails sent on every worker run.
+  emailBatchSize = 20
+
+  // defaultLocale is used for users without a locale and for templates
+  // missing a translation.
+  defaultLocale = "en"
+)
+
+//go:embed templates/email
+var emailTemplates embed.FS
+
+// Email is a rendered message. Templates live in templates/email as
+// <name>.<locale>.txt and <name>.<locale>.html; the text one also defines
+// the "subject" template.
+type Email struct {
+  To      string
+  Subject string
+  Text    string
+  HTML    string
+}
+
+// renderEmail renders the template name in locale, falling back to the
+// default locale when there is no translation.
+func renderEmail(name, locale string, data map[string]any) (*Email, error) {
+  if _, err := fs.Stat(emailTemplates, "templates/email/"+name+"."+locale+".txt"); nil != err {
+    locale = defaultLocale
+  }
+
+  path := "templates/email/" + name + "." + locale
+
+  text, err := texttemplate.ParseFS(emailTemplates, path+".txt")
+  if nil != err {
+    return nil, err
+  }
+
+  html, err := htmltemplate.ParseFS(emailTemplates, path+".html")
+  if nil != err {
+    return nil, err
+  }
+
+  var subject, textBody, htmlBody bytes.Buffer
+
+  if err = text.ExecuteTemplate(&subject, "subject", data); nil != err {
+    return nil, err
+  }
+
+  if err = text.Execute(&textBody, data); nil != err {
+    return nil, err
+  }
+
+  if err = html.Execute(&htmlBody, data); nil != err {
+    return nil, err
+  }
+
+  return &Email{
+    Subject: strings.TrimSpace(subject.String()),
+    Text:    textBody.String(),
+    HTML:    htmlBody.String(),
+  }, nil
+}
+
+// normalizeLocale maps a user supplied locale such as "es-NI" to one the
+// templates are written in.
+func normalizeLocale(locale string) string {
+  locale, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(locale)), "-")
+  if "" == locale {
+    return defaultLocale
+  }
+
+  if matches, _ := fs.Glob(emailTemplates, "templates/email/*."+locale+".txt"); 0 == len(matches) {
+    return defaultLocale
+  }
+
+  return locale
+}
+
+// message encodes e as a multipart/alternative MIME message.
+func (e *Email) message(from string) ([]byte, error) {
+  var (
+    body   bytes.Buffer
+    writer = multipart.NewWriter(&body)
+  )
+
+  for _, part := range []struct{ contentType, content string }{
+    {"text/plain; charset=utf-8", e.Text},
+    {"text/html; charset=utf-8", e.HTML},
+  } {
+    partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+      "Content-Type":              {part.contentType},
+      "Content-Transfer-Encoding": {"quoted-printable"},
+    })
+    if nil != err {
+      return nil, err
+    }
+
+    encoder := quotedprintable.NewWriter(partWriter)
+    if _, err = encoder.Write([]byte(part.content)); nil != err {
+      return nil, err
+    }
+
+    if err = encoder.Close(); nil != err {
+      return nil, err
+    }
+  }
+
+  if err := writer.Close(); nil != err {
+    return nil, err
+  }
+
+  var message bytes.Buffer
+
+  fmt.Fprintf(&message, "From: %s\r\n", from)
+  fmt.Fprintf(&message, "To: %s\r\n", e.To)
+  fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+  fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+  fmt.Fprintf(&message, "Message-ID: <%s@motonica>\r\n", randomHex(16))
+  fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+  fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+  message.Write(body.Bytes())
+
+  return message.Bytes(), nil
+}
+
+// Sender hands a rendered email over for delivery.
+type Sender interface {
+  Send(ctx context.Context, email *Email) error
+}
+
+type SMTPSender struct {
+  addr string
+  from string
+  auth smtp.Auth
+}
+
+func NewSMTPSender(host, port, username, password, from string) *SMTPSender {
+  var auth smtp.Auth
+  if "" != username {
+    auth = smtp.PlainAuth("", username, password, host)
+  }
+
+  return &SMTPSender{net.JoinHostPort(host, port), from, auth}
+}
+
+func (s *SMTPSender) Send(ctx context.Context, email *Email) error {
+  message, err := email.message(s.from)
+  if nil != err {
+    return err
+  }
+
+  return smtp.SendMail(s.addr, s.auth, s.from, []string{email.To}, message)
+}
+
+// DirectorySender writes every email as an .eml file, which is handy in
+// development where there is no mail server.
+type DirectorySender struct {
+  dir  string
+  from string
+}
+
+func NewDirectorySender(dir, from string) *DirectorySender {
+  return &DirectorySender{dir, from}
+}
+
+func (s *DirectorySender) Send(ctx context.Context, email *Email) error {
+  message, err := email.message(s.from)
+  if nil != err {
+    return err
+  }
+
+  if err = os.MkdirAll(s.dir, 0o755); nil != err {
+    return err
+  }
+
+  name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), randomHex(4))
+
+  return os.WriteFile(filepath.Join(s.dir, name), message, 0o644)
+}
+
+// emailSenderFromEnv picks the sender named by EMAIL_SENDER, which is either
+// "smtp" or "directory", the default.
+func emailSenderFromEnv() Sender {
+  from := os.Getenv("EMAIL_FROM")
+  if "" == from {
+    from = "Motonica <no-reply@motonica.local>"
+  }
+
+  if "smtp" == os.Getenv("EMAIL_SENDER") {
+    port := os.Getenv("SMTP_PORT")
+    if "" == port {
+      port = "587"
+    }
+
+    return NewSMTPSender(os.Getenv("SMTP_HOST"), port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+  }
+
+  dir := os.Getenv("EMAIL_DIRECTORY")
+  if "" == dir {
+    dir = "mail"
+  }
+
+  return NewDirectorySender(dir, from)
+}
+
+type dueEmail struct {
+  id       int
+  attempts int
+  email    Email
+}
+
+type EmailService struct {
+  db        *sql.DB
+  sender    Sender
+  retention time.Duration
+}
+
+func NewEmailService(db *sql.DB, sender Sender, retention time.Duration) *EmailService {
+  return &EmailService{db, sender, retention}
+}
+
+// Enqueue renders the template name for to and stores it in the outbox.
+// Passing a transaction as q makes the email part of the change that caused
+// it, so it is only sent if that change is committed.
+func (s *EmailService) Enqueue(ctx context.Context, q querier, to, name, locale string, data map[string]any) error {
+  enqueueEmailQuery := `
+  INSERT INTO email_outbox (recipient, template, locale, subject, text_body, html_body)
+                    VALUES (@recipient, @template, @locale, @subject, @text_body, @html_body);`
+
+  locale = normalizeLocale(locale)
+
+  email, err := renderEmail(name, locale, data)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  _, err = q.ExecContext(ctx, enqueueEmailQuery,
+    sql.Named("recipient", to),
+    sql.Named("template", name),
+    sql.Named("locale", locale),
+    sql.Named("subject", email.Subject),
+    sql.Named("text_body", email.Text),
+    sql.Named("html_body", email.HTML))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Deliver sends the emails that are due and schedules a retry for those
+// that could not be sent. Bodies are dropped once an email is sent or has
+// failed for good, since they hold one-time links.
+func (s *EmailService) Deliver(ctx context.Context) error {
+  getDueEmailsQuery := `
+  SELECT id, attempts, recipient, subject, text_body, html_body
+    FROM email_outbox
+   WHERE status = 'pending'
+     AND next_attempt_at <= @now
+ORDER BY next_attempt_at
+   LIMIT @limit;`
+
+  result, err := s.db.QueryContext(ctx, getDueEmailsQuery,
+    sql.Named("now", time.Now().UTC().Format(time.DateTime)),
+    sql.Named("limit", emailBatchSize))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  due := make([]*dueEmail, 0)
+
+  for result.Next() {
+    var email dueEmail
+
+    err = result.Scan(&email.id, &email.attempts, &email.email.To, &email.email.Subject, &email.email.Text, &email.email.HTML)
+    if nil != err {
+      result.Close()
+      slog.Error(err.Error())
+      return err
+    }
+
+    due = append(due, &email)
+  }
+
+  result.Close()
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, email := range due {
+    err = s.sender.Send(ctx, &email.email)
+    if err = s.recordAttempt(ctx, email, err); nil != err {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (s *EmailService) recordAttempt(ctx context.Context, email *dueEmail, sendErr error) error {
+  recordAttemptQuery := `
+  UPDATE email_outbox
+     SET status = @status,
+         attempts = attempts + 1,
+         next_attempt_at = @next_attempt_at,
+         last_error = @last_error,
+         text_body = CASE WHEN 'pending' = @status THEN text_body END,
+         html_body = CASE WHEN 'pending' = @status THEN html_body END,
+         sent_at = CASE WHEN 'sent' = @status THEN current_timestamp END
+   WHERE id = @id;`
+
+  var (
+    attempts      = email.attempts + 1
+    status        = EmailSent
+    nextAttemptAt = time.Now().UTC()
+    lastError     any
+  )
+
+  if nil != sendErr {
+    slog.Error(fmt.Sprintf("email %d: %v", email.id, sendErr))
+    lastError = sendErr.Error()
+    status = EmailPending
+    nextAttemptAt = nextAttemptAt.Add(exponentialBackoff(emailBaseBackoff, emailMaxBackoff, attempts))
+
+    if emailMaxAttempts <= attempts {
+      status = EmailFailed
+    }
+  }
+
+  _, err := s.db.ExecContext(ctx, recordAttemptQuery,
+    sql.Named("id", email.id),
+    sql.Named("status", status),
+    sql.Named("next_attempt_at", nextAttemptAt.Format(time.DateTime)),
+    sql.Named("last_error", lastError))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Purge deletes the emails that left the queue longer than the retention
+// period ago.
+func (s *EmailService) Purge(ctx context.Context) error {
+  purgeQuery := `
+  DELETE
+    FROM email_outbox
+   WHERE status <> 'pending'
+     AND COALESCE(sent_at, next_attempt_at) < @cutoff;`
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  _, err := s.db.ExecContext(ctx, purgeQuery, sql.Named("cutoff", time.Now().UTC().Add(-s.retention).Format(time.DateTime)))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "log/slog"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const AuditActionExpire = "expire"
+
+// ListingTTL is how long a listing stays published after it is created or
+// renewed, optionally overridden per user role.
+type ListingTTL struct {
+  Default time.Duration
+  ByRole  map[string]time.Duration
+}
+
+// listingTTLFromEnv reads LISTING_TTL_DAYS and any LISTING_TTL_DAYS_<ROLE>
+// override, e.g. LISTING_TTL_DAYS_DEALER=90.
+func listingTTLFromEnv() ListingTTL {
+  const prefix = "LISTING_TTL_DAYS"
+
+  ttl := ListingTTL{Default: 30 * 24 * time.Hour, ByRole: map[string]time.Duration{}}
+
+  for _, variable := range os.Environ() {
+    key, value, _ := strings.Cut(variable, "=")
+    if !strings.HasPrefix(key, prefix) {
+      continue
+    }
+
+    days, err := strconv.Atoi(value)
+    if nil != err || 0 >= days {
+      slog.Error("invalid number of days in " + key)
+      continue
+    }
+
+    if prefix == key {
+      ttl.Default = time.Duration(days) * 24 * time.Hour
+    } else if role, ok := strings.CutPrefix(key, prefix+"_"); ok {
+      ttl.ByRole[strings.ToLower(role)] = time.Duration(days) * 24 * time.Hour
+    }
+  }
+
+  return ttl
+}
+
+func (t ListingTTL) For(role string) time.Duration {
+  if ttl, ok := t.ByRole[role]; ok {
+    return ttl
+  }
+
+  return t.Default
+}
+
+type ExpiryReminder struct {
+  MotorcycleID int
+  OwnerID      int
+  PostTitle    string
+  ExpiresAt    string
+}
+
+type ListingExpiryService struct {
+  db            *sql.DB
+  audit         *AuditService
+  webhooks      *WebhookService
+  notifications *NotificationService
+  verifications *EmailVerificationService
+  listings      *ListingBroker
+  ttl           ListingTTL
+  reminderLead  time.Duration
+}
+
+func NewListingExpiryService(db *sql.DB, audit *AuditService, webhooks *WebhookService, notifications *NotificationService, verifications *EmailVerificationService, listings *ListingBroker, ttl ListingTTL, reminderLead time.Duration) *ListingExpiryService {
+  return &ListingExpiryService{db, audit, webhooks, notifications, verifications, listings, ttl, reminderLead}
+}
+
+// ExpiresAt tells when a listing published now by ownerID expires.
+func (s *ListingExpiryService) ExpiresAt(ctx context.Context, tx *sql.Tx, ownerID int) (expiresAt string, err error) {
+  getOwnerRoleQuery := `
+  SELECT role
+    FROM "user"
+   WHERE id = $1;`
+
+  var role string
+
+  err = tx.QueryRowContext(ctx, getOwnerRoleQuery, ownerID).Scan(&role)
+  if nil != err {
+    slog.Error(err.Error())
+    return "", err
+  }
+
+  return time.Now().UTC().Add(s.ttl.For(role)).Format(time.DateTime), nil
+}
+
+func (s *ListingExpiryService) Renew(ctx context.Context, ownerID, id int) (expiresAt string, err error) {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return "", err
+  }
+
+  defer tx.Rollback()
+
+  renewMotorcycleQuery := `
+  UPDATE motorcycle
+     SET status = 'active',
+         renewed_at = current_timestamp,
+         expires_at = @expires_at,
+         reminded_at = NULL,
+         updated_at = current_timestamp
+   WHERE id = @id
+     AND owner_id = @owner_id
+     AND status IN ('active', 'expired')
+     AND deleted_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  before, err := snapshot(ctx, tx, motorcycleSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return "", ErrMotorcycleNotFound
+    }
+
+    return "", err
+  }
+
+  if err = s.verifications.RequireVerified(ctx, tx, ownerID); nil != err {
+    return "", err
+  }
+
+  expiresAt, err = s.ExpiresAt(ctx, tx, ownerID)
+  if nil != err {
+    return "", err
+  }
+
+  result, err := tx.ExecContext(ctx, renewMotorcycleQuery,
+    sql.Named("id", id),
+    sql.Named("owner_id", ownerID),
+    sql.Named("expires_at", expiresAt))
+  if nil != err {
+    slog.Error(err.Error())
+    return "", err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return "", ErrMotorcycleNotFound
+  }
+
+  after, err := snapshot(ctx, tx, motorcycleSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    return "", err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionUpdate, "motorcycle", id, before, after)
+  if nil != err {
+    return "", err
+  }
+
+  err = s.webhooks.Enqueue(ctx, tx, ownerID, EventMotorcycleUpdated, after)
+  if nil != err {
+    return "", err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return "", err
+  }
+
+  s.listings.Publish(EventMotorcycleUpdated, after)
+
+  return expiresAt, nil
+}
+
+// Sweep gives an expiry date to listings published before expiry existed,
+// reminds owners of listings about to expire and expires the overdue ones.
+func (s *ListingExpiryService) Sweep(ctx context.Context) error {
+  if err := s.backfill(ctx); nil != err {
+    return err
+  }
+
+  if err := s.remindExpiring(ctx); nil != err {
+    return err
+  }
+
+  return s.expireOverdue(ctx)
+}
+
+func (s *ListingExpiryService) backfill(ctx context.Context) error {
+  backfillRoleQuery := `
+  UPDATE motorcycle
+     SET expires_at = datetime(renewed_at, '+' || @seconds || ' seconds')
+   WHERE expires_at IS NULL
+     AND owner_id IN (SELECT id FROM "user" WHERE role = @role);`
+
+  backfillDefaultQuery := `
+  UPDATE motorcycle
+     SET expires_at = datetime(renewed_at, '+' || @seconds || ' seconds')
+   WHERE expires_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  for role, ttl := range s.ttl.ByRole {
+    _, err := s.db.ExecContext(ctx, backfillRoleQuery, sql.Named("role", role), sql.Named("seconds", int64(ttl.Seconds())))
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+  }
+
+  _, err := s.db.ExecContext(ctx, backfillDefaultQuery, sql.Named("seconds", int64(s.ttl.Default.Seconds())))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+func (s *ListingExpiryService) remindExpiring(ctx context.Context) error {
+  getExpiringQuery := `
+  SELECT id, owner_id, post_title, expires_at
+    FROM motorcycle
+   WHERE status = 'active'
+     AND deleted_at IS NULL
+     AND reminded_at IS NULL
+     AND expires_at > @now
+     AND expires_at <= @remind_before;`
+
+  markRemindedQuery := `
+  UPDATE motorcycle
+     SET reminded_at = current_timestamp
+   WHERE id = $1;`
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  now := time.Now().UTC()
+
+  result, err := s.db.QueryContext(ctx, getExpiringQuery,
+    sql.Named("now", now.Format(time.DateTime)),
+    sql.Named("remind_before", now.Add(s.reminderLead).Format(time.DateTime)))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  reminders := make([]*ExpiryReminder, 0)
+
+  for result.Next() {
+    var reminder ExpiryReminder
+
+    err = result.Scan(&reminder.MotorcycleID, &reminder.OwnerID, &reminder.PostTitle, &reminder.ExpiresAt)
+    if nil != err {
+      result.Close()
+      slog.Error(err.Error())
+      return err
+    }
+
+    reminders = append(reminders, &reminder)
+  }
+
+  result.Close()
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, reminder := range reminders {
+    if err = s.remind(ctx, reminder); nil != err {
+      continue
+    }
+
+    _, err = s.db.ExecContext(ctx, markRemindedQuery, reminder.MotorcycleID)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (s *ListingExpiryService) remind(ctx context.Context, reminder *ExpiryReminder) error {
+  return s.notifications.Notify(ctx, s.db, reminder.OwnerID, NotificationListingExpiring, map[string]any{
+    "motorcycle_id": reminder.MotorcycleID,
+    "post_title":    reminder.PostTitle,
+    "expires_at":    reminder.ExpiresAt,
+  })
+}
+
+func (s *ListingExpiryService) expireOverdue(ctx context.Context) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  expireQuery := `
+  UPDATE motorcycle
+     SET status = 'expired',
+         updated_at = current_timestamp
+   WHERE status = 'active'
+     AND deleted_at IS NULL
+     AND expires_at <= @now
+    RETURNING id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  expired, err := motorcycleSnapshots(ctx, tx, expireQuery, sql.Named("now", time.Now().UTC().Format(time.DateTime)))
+  if nil != err {
+    return err
+  }
+
+  for _, after := range expired {
+    id, idOK := after["id"].(int64)
+    ownerID, ownerOK := after["owner_id"].(int64)
+    if !idOK || !ownerOK {
+      slog.Error("skipping expired listing with an unexpected id or owner", "id", after["id"], "owner_id", after["owner_id"])
+      continue
+    }
+
+    err = s.audit.Record(ctx, tx, AuditActionExpire, "motorcycle", int(id),
+      map[string]any{"status": MotorcycleStatusActive},
+      map[string]any{"status": MotorcycleStatusExpired})
+    if nil != err {
+      return err
+    }
+
+    err = s.webhooks.Enqueue(ctx, tx, int(ownerID), EventMotorcycleExpired, after)
+    if nil != err {
+      return err
+    }
+
+    err = s.notifications.Notify(ctx, tx, int(ownerID), NotificationListingExpired, map[string]any{
+      "motorcycle_id": id,
+      "post_title":    after["post_title"],
+    })
+    if nil != err {
+      return err
+    }
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, after := range expired {
+    s.listings.Publish(EventMotorcycleExpired, after)
+  }
+
+  return nil
+}
+
+type ListingExpiryHandler struct {
+  s *ListingExpiryService
+}
+
+func NewListingExpiryHandler(service *ListingExpiryService) *ListingExpiryHandler {
+  return &ListingExpiryHandler{service}
+}
+
+func (h *ListingExpiryHandler) Renew(w http.ResponseWriter, r *http.Request) {
+  ownerID := principalFrom(r.Context()).UserID
+
+  motorcycleID, err := strconv.Atoi(r.PathValue("motorcycle_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  expiresAt, err := h.s.Renew(r.Context(), ownerID, motorcycleID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(map[string]string{"expires_at": expiresAt})
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
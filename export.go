@@ -0,0 +1,759 @@
+package main
+
+import (
+  "archive/zip"
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "mime"
+  "net/http"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "time"
+)
+
+const (
+  DataExportStatusPending = "pending"
+  DataExportStatusReady   = "ready"
+  DataExportStatusFailed  = "failed"
+  DataExportStatusExpired = "expired"
+)
+
+const (
+  // dataExportBatchSize is how many pending exports a run builds.
+  dataExportBatchSize = 5
+
+  // dataExportMaxImageSize is the largest image copied into an archive.
+  dataExportMaxImageSize = 10 << 20
+)
+
+// DataExport is an archive of everything a user stored with us. It is
+// built in the background, then kept for download until it expires.
+type DataExport struct {
+  ID          int     `json:"id"`
+  Status      string  `json:"status"`
+  Size        *int64  `json:"size,omitempty"`
+  CreatedAt   string  `json:"created_at"`
+  CompletedAt *string `json:"completed_at"`
+  ExpiresAt   *string `json:"expires_at"`
+}
+
+var (
+  ErrDataExportNotFound = newError(ErrNotFound, "data_export_not_found", "data export not found")
+  ErrDataExportFailed   = newError(ErrGone, "data_export_failed", "data export could not be built, request a new one")
+  ErrDataExportExpired  = newError(ErrGone, "data_export_expired", "data export expired, request a new one")
+)
+
+const dataExportSnapshotQuery = `
+  SELECT id,
+         user_id,
+         status,
+         created_at,
+         completed_at,
+         expires_at
+    FROM data_export
+   WHERE id = @id;`
+
+func dataExportDirFromEnv() string {
+  dir := os.Getenv("DATA_EXPORT_DIRECTORY")
+  if "" == dir {
+    dir = "exports"
+  }
+
+  return dir
+}
+
+// rows returns every row query yields as a column to value map, like
+// snapshot does for a single row.
+func rows(ctx context.Context, q querier, query string, args ...any) ([]map[string]any, error) {
+  result, err := q.QueryContext(ctx, query, args...)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  columns, err := result.Columns()
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  all := make([]map[string]any, 0)
+
+  for result.Next() {
+    values := make([]any, len(columns))
+    pointers := make([]any, len(columns))
+    for i := range values {
+      pointers[i] = &values[i]
+    }
+
+    if err = result.Scan(pointers...); nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    row := make(map[string]any, len(columns))
+    for i, column := range columns {
+      if b, ok := values[i].([]byte); ok {
+        values[i] = string(b)
+      }
+
+      row[column] = values[i]
+    }
+
+    all = append(all, row)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return all, nil
+}
+
+type DataExportService struct {
+  db            *sql.DB
+  audit         *AuditService
+  notifications *NotificationService
+  images        *http.Client
+  dir           string
+  ttl           time.Duration
+}
+
+func NewDataExportService(db *sql.DB, audit *AuditService, notifications *NotificationService, images *http.Client, dir string, ttl time.Duration) *DataExportService {
+  return &DataExportService{db, audit, notifications, images, dir, ttl}
+}
+
+// Create asks for a new export of userID's data. While one is being built,
+// asking again returns that one instead.
+func (s *DataExportService) Create(ctx context.Context, userID int) (*DataExport, error) {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  getPendingExportQuery := `
+  SELECT id,
+         status,
+         size,
+         created_at,
+         completed_at,
+         expires_at
+    FROM data_export
+   WHERE user_id = $1
+     AND status = 'pending';`
+
+  createExportQuery := `
+  INSERT INTO data_export (user_id)
+                   VALUES (@user_id)
+    RETURNING id, status, size, created_at, completed_at, expires_at;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  export := new(DataExport)
+
+  err = tx.QueryRowContext(ctx, getPendingExportQuery, userID).
+    Scan(&export.ID, &export.Status, &export.Size, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+  if nil == err {
+    return export, nil
+  }
+
+  if !errors.Is(err, sql.ErrNoRows) {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  err = tx.QueryRowContext(ctx, createExportQuery, sql.Named("user_id", userID)).
+    Scan(&export.ID, &export.Status, &export.Size, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  after, err := snapshot(ctx, tx, dataExportSnapshotQuery, sql.Named("id", export.ID))
+  if nil != err {
+    return nil, err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionCreate, "data_export", export.ID, nil, after)
+  if nil != err {
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return export, nil
+}
+
+// Get returns the export id of userID along with the path of its archive,
+// which is only set once it is ready. Archives past their expiry are gone
+// even before Purge got to them.
+func (s *DataExportService) Get(ctx context.Context, userID, id int) (*DataExport, string, error) {
+  getExportQuery := `
+  SELECT id,
+         CASE WHEN expires_at < @now THEN 'expired' ELSE status END,
+         size,
+         created_at,
+         completed_at,
+         expires_at,
+         coalesce(path, '')
+    FROM data_export
+   WHERE id = @id
+     AND user_id = @user_id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  var (
+    export  DataExport
+    archive string
+  )
+
+  err := s.db.QueryRowContext(ctx, getExportQuery,
+    sql.Named("id", id),
+    sql.Named("user_id", userID),
+    sql.Named("now", time.Now().UTC().Format(time.DateTime))).
+    Scan(&export.ID, &export.Status, &export.Size, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt, &archive)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, "", ErrDataExportNotFound
+    }
+
+    slog.Error(err.Error())
+    return nil, "", err
+  }
+
+  switch export.Status {
+  case DataExportStatusFailed:
+    return nil, "", ErrDataExportFailed
+  case DataExportStatusExpired:
+    return nil, "", ErrDataExportExpired
+  }
+
+  return &export, archive, nil
+}
+
+// Build builds the pending exports. An export that cannot be built is
+// marked failed rather than retried, as the user can simply ask again.
+func (s *DataExportService) Build(ctx context.Context) error {
+  getPendingExportsQuery := `
+  SELECT id, user_id
+    FROM data_export
+   WHERE status = 'pending'
+ORDER BY created_at
+   LIMIT @limit;`
+
+  failExportQuery := `
+  UPDATE data_export
+     SET status = 'failed',
+         completed_at = current_timestamp
+   WHERE id = @id;`
+
+  pending, err := rows(ctx, s.db, getPendingExportsQuery, sql.Named("limit", dataExportBatchSize))
+  if nil != err {
+    return err
+  }
+
+  if err = os.MkdirAll(s.dir, 0o700); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, export := range pending {
+    id, idOK := export["id"].(int64)
+    userID, userOK := export["user_id"].(int64)
+    if !idOK || !userOK {
+      slog.Error("skipping data export with an unexpected id or user", "id", export["id"], "user_id", export["user_id"])
+      continue
+    }
+
+    if err = s.build(ctx, int(id), int(userID)); nil != err {
+      slog.Error(fmt.Sprintf("could not build data export %d: %s", id, err.Error()))
+
+      if _, err = s.db.ExecContext(ctx, failExportQuery, sql.Named("id", id)); nil != err {
+        slog.Error(err.Error())
+      }
+    }
+  }
+
+  return nil
+}
+
+func (s *DataExportService) build(ctx context.Context, id, userID int) error {
+  getUserQuery := `
+  SELECT id,
+         first_name,
+         middle_name,
+         last_name,
+         surname,
+         email,
+         phone_number,
+         picture_url,
+         role,
+         locale,
+         show_phone_on_listings,
+         show_email_on_listings,
+         reveal_phone,
+         reveal_email,
+         email_verified_at,
+         created_at,
+         updated_at
+    FROM "user"
+   WHERE id = @user_id
+     AND deleted_at IS NULL;`
+
+  getMotorcyclesQuery := `
+  SELECT id,
+         post_title,
+         price,
+         type,
+         mileage,
+         brand,
+         model,
+         year,
+         engine,
+         color,
+         description,
+         location,
+         status,
+         expires_at,
+         created_at,
+         updated_at,
+         deleted_at
+    FROM motorcycle
+   WHERE owner_id = @user_id
+ORDER BY id;`
+
+  getImagesQuery := `
+  SELECT mi.id,
+         mi.motorcycle_id,
+         mi.url,
+         mi.created_at,
+         mi.updated_at
+    FROM motorcycle_image mi
+    JOIN motorcycle m
+      ON m.id = mi.motorcycle_id
+   WHERE m.owner_id = @user_id
+ORDER BY mi.id;`
+
+  getFavoritesQuery := `
+  SELECT f.motorcycle_id,
+         m.post_title
+    FROM favorite f
+    JOIN motorcycle m
+      ON m.id = f.motorcycle_id
+   WHERE f.user_id = @user_id
+ORDER BY f.motorcycle_id;`
+
+  getContactRevealsQuery := `
+  SELECT cr.motorcycle_id,
+         m.post_title,
+         cr.created_at
+    FROM contact_reveal cr
+    JOIN motorcycle m
+      ON m.id = cr.motorcycle_id
+   WHERE cr.user_id = @user_id
+ORDER BY cr.id;`
+
+  getNotificationsQuery := `
+  SELECT id,
+         type,
+         data,
+         read_at,
+         created_at
+    FROM notification
+   WHERE user_id = @user_id
+ORDER BY id;`
+
+  getSessionsQuery := `
+  SELECT id,
+         device_name,
+         user_agent,
+         ip,
+         created_at,
+         last_seen_at,
+         expires_at,
+         revoked_at
+    FROM session
+   WHERE user_id = @user_id
+ORDER BY id;`
+
+  getAPIKeysQuery := `
+  SELECT id,
+         name,
+         prefix,
+         scopes,
+         last_used_at,
+         created_at,
+         revoked_at
+    FROM api_key
+   WHERE user_id = @user_id
+ORDER BY id;`
+
+  getWebhookSubscriptionsQuery := `
+  SELECT id,
+         url,
+         event_types,
+         created_at
+    FROM webhook_subscription
+   WHERE user_id = @user_id
+ORDER BY id;`
+
+  // Other actors, such as admins, are named by id only, without their IP.
+  getAuditLogQuery := `
+  SELECT id,
+         actor_id,
+         action,
+         entity_type,
+         entity_id,
+         changes,
+         request_id,
+         CASE WHEN actor_id = @user_id THEN ip END AS ip,
+         created_at
+    FROM audit_log
+   WHERE actor_id = @user_id
+      OR (entity_type IN ('user', 'two_factor') AND entity_id = @user_id)
+ORDER BY id;`
+
+  // Bodies are left out, as those still queued hold one-time links.
+  getEmailsQuery := `
+  SELECT id,
+         recipient,
+         template,
+         subject,
+         status,
+         created_at,
+         sent_at
+    FROM email_outbox
+   WHERE recipient = (SELECT email
+                        FROM "user"
+                       WHERE id = @user_id)
+ORDER BY id;`
+
+  readyExportQuery := `
+  UPDATE data_export
+     SET status = 'ready',
+         path = @path,
+         size = @size,
+         completed_at = current_timestamp,
+         expires_at = @expires_at
+   WHERE id = @id
+     AND status = 'pending';`
+
+  user, err := snapshot(ctx, s.db, getUserQuery, sql.Named("user_id", userID))
+  if nil != err {
+    return err
+  }
+
+  entities := map[string]string{
+    "motorcycles.json":           getMotorcyclesQuery,
+    "motorcycle_images.json":     getImagesQuery,
+    "favorites.json":             getFavoritesQuery,
+    "contact_reveals.json":       getContactRevealsQuery,
+    "notifications.json":         getNotificationsQuery,
+    "sessions.json":              getSessionsQuery,
+    "api_keys.json":              getAPIKeysQuery,
+    "webhook_subscriptions.json": getWebhookSubscriptionsQuery,
+    "audit_log.json":             getAuditLogQuery,
+    "emails.json":                getEmailsQuery,
+  }
+
+  data := map[string]any{"user.json": user}
+
+  for name, query := range entities {
+    if data[name], err = rows(ctx, s.db, query, sql.Named("user_id", userID)); nil != err {
+      return err
+    }
+  }
+
+  archive := filepath.Join(s.dir, strconv.Itoa(id)+".zip")
+
+  size, err := s.write(ctx, archive, data)
+  if nil != err {
+    return err
+  }
+
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    os.Remove(archive)
+    return err
+  }
+
+  defer tx.Rollback()
+
+  expiresAt := time.Now().UTC().Add(s.ttl).Format(time.DateTime)
+
+  _, err = tx.ExecContext(ctx, readyExportQuery,
+    sql.Named("id", id),
+    sql.Named("path", archive),
+    sql.Named("size", size),
+    sql.Named("expires_at", expiresAt))
+  if nil != err {
+    os.Remove(archive)
+    return err
+  }
+
+  err = s.notifications.Notify(ctx, tx, userID, NotificationDataExportReady, map[string]any{
+    "data_export_id": id,
+    "expires_at":     expiresAt,
+  })
+  if nil != err {
+    os.Remove(archive)
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    os.Remove(archive)
+    return err
+  }
+
+  return nil
+}
+
+// write stores data as one JSON file per entity in a zip archive at
+// archive, along with the images the listings point to. Images that cannot
+// be fetched are left out, with the reason next to their URL.
+func (s *DataExportService) write(ctx context.Context, archive string, data map[string]any) (int64, error) {
+  file, err := os.CreateTemp(s.dir, "export-*.tmp")
+  if nil != err {
+    return 0, err
+  }
+
+  defer os.Remove(file.Name())
+  defer file.Close()
+
+  writer := zip.NewWriter(file)
+
+  images, _ := data["motorcycle_images.json"].([]map[string]any)
+  for _, image := range images {
+    url, _ := image["url"].(string)
+
+    name, err := s.copyImage(ctx, writer, url, fmt.Sprintf("images/%d", image["id"]))
+    if nil != err {
+      image["error"] = err.Error()
+    } else {
+      image["file"] = name
+    }
+  }
+
+  for name, entity := range data {
+    encoded, err := json.MarshalIndent(entity, "", "  ")
+    if nil != err {
+      return 0, err
+    }
+
+    entry, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+    if nil != err {
+      return 0, err
+    }
+
+    if _, err = entry.Write(encoded); nil != err {
+      return 0, err
+    }
+  }
+
+  if err = writer.Close(); nil != err {
+    return 0, err
+  }
+
+  info, err := file.Stat()
+  if nil != err {
+    return 0, err
+  }
+
+  if err = file.Close(); nil != err {
+    return 0, err
+  }
+
+  if err = os.Rename(file.Name(), archive); nil != err {
+    return 0, err
+  }
+
+  return info.Size(), nil
+}
+
+// copyImage fetches the image at url into the archive as name, with the
+// extension of the URL or else of its content type, and returns the name
+// it was stored under.
+func (s *DataExportService) copyImage(ctx context.Context, writer *zip.Writer, url, name string) (string, error) {
+  request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+  if nil != err {
+    return "", err
+  }
+
+  response, err := s.images.Do(request)
+  if nil != err {
+    return "", err
+  }
+
+  defer response.Body.Close()
+
+  if http.StatusOK != response.StatusCode {
+    return "", fmt.Errorf("fetching the image failed with status %d", response.StatusCode)
+  }
+
+  extension := path.Ext(request.URL.Path)
+  if extensions, _ := mime.ExtensionsByType(response.Header.Get("Content-Type")); "" == extension && 0 < len(extensions) {
+    extension = extensions[0]
+  }
+
+  image, err := io.ReadAll(io.LimitReader(response.Body, dataExportMaxImageSize+1))
+  if nil != err {
+    return "", err
+  }
+
+  if dataExportMaxImageSize < len(image) {
+    return "", fmt.Errorf("image is larger than %d bytes", dataExportMaxImageSize)
+  }
+
+  entry, err := writer.CreateHeader(&zip.FileHeader{Name: name + extension, Method: zip.Deflate, Modified: time.Now()})
+  if nil != err {
+    return "", err
+  }
+
+  if _, err = entry.Write(image); nil != err {
+    return "", err
+  }
+
+  return name + extension, nil
+}
+
+// Purge deletes the archives that expired, and those of deleted accounts
+// right away.
+func (s *DataExportService) Purge(ctx context.Context) error {
+  getExpiredExportsQuery := `
+  SELECT id, path
+    FROM data_export
+   WHERE status = 'ready'
+     AND (expires_at < @now
+          OR user_id IN (SELECT id FROM "user" WHERE deleted_at IS NOT NULL));`
+
+  expireExportQuery := `
+  UPDATE data_export
+     SET status = 'expired',
+         path = NULL
+   WHERE id = @id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  expired, err := rows(ctx, s.db, getExpiredExportsQuery, sql.Named("now", time.Now().UTC().Format(time.DateTime)))
+  if nil != err {
+    return err
+  }
+
+  for _, export := range expired {
+    archive, _ := export["path"].(string)
+
+    if err = os.Remove(archive); nil != err && !errors.Is(err, os.ErrNotExist) {
+      slog.Error(err.Error())
+      continue
+    }
+
+    if _, err = s.db.ExecContext(ctx, expireExportQuery, sql.Named("id", export["id"])); nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+  }
+
+  return nil
+}
+
+type DataExportHandler struct {
+  s *DataExportService
+}
+
+func NewDataExportHandler(service *DataExportService) *DataExportHandler {
+  return &DataExportHandler{service}
+}
+
+func (h *DataExportHandler) Create(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  export, err := h.s.Create(r.Context(), userID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(export)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.Header().Set("Location", "/me/export/"+strconv.Itoa(export.ID))
+  w.WriteHeader(http.StatusAccepted)
+  w.Write(response)
+}
+
+// Get downloads the archive once it is ready, and until then answers 202
+// with the export, for clients to poll.
+func (h *DataExportHandler) Get(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  exportID, err := strconv.Atoi(r.PathValue("export_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  export, archive, err := h.s.Get(r.Context(), userID, exportID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  if DataExportStatusReady != export.Status {
+    response, err := json.Marshal(export)
+    if nil != err {
+      slog.Error(err.Error())
+      writeError(w, r, err)
+      return
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write(response)
+    return
+  }
+
+  file, err := os.Open(archive)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  defer file.Close()
+
+  info, err := file.Stat()
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/zip")
+  w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"motonica-export-%d.zip\"", export.ID))
+  w.Header().Set("Cache-Control", "private, no-store")
+  http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "log/slog"
+  "net/http"
+  "time"
+)
+
+type FavoriteCreation struct {
+  MotorcycleID int `json:"motorcycle_id"`
+}
+
+type FavoriteService struct {
+  db            *sql.DB
+  webhooks      *WebhookService
+  notifications *NotificationService
+}
+
+func NewFavoriteService(db *sql.DB, webhooks *WebhookService, notifications *NotificationService) *FavoriteService {
+  return &FavoriteService{db, webhooks, notifications}
+}
+
+// Add marks a listing as a favorite of userID. Adding the same favorite
+// twice is not an error.
+func (s *FavoriteService) Add(ctx context.Context, userID, motorcycleID int) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  getOwnerQuery := `
+  SELECT owner_id, post_title
+    FROM motorcycle
+   WHERE id = $1
+     AND status = 'active'
+     AND deleted_at IS NULL;`
+
+  addFavoriteQuery := `
+  INSERT INTO favorite (user_id, motorcycle_id)
+       SELECT @user_id, @motorcycle_id
+        WHERE NOT EXISTS (SELECT 1
+                            FROM favorite
+                           WHERE user_id = @user_id
+                             AND motorcycle_id = @motorcycle_id);`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    ownerID   int
+    postTitle string
+  )
+
+  err = tx.QueryRowContext(ctx, getOwnerQuery, motorcycleID).Scan(&ownerID, &postTitle)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrMotorcycleNotFound
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  result, err := tx.ExecContext(ctx, addFavoriteQuery, sql.Named("user_id", userID), sql.Named("motorcycle_id", motorcycleID))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if affected, _ := result.RowsAffected(); 0 == affected {
+    return nil
+  }
+
+  err = s.webhooks.Enqueue(ctx, tx, ownerID, EventFavoriteAdded, map[string]any{"motorcycle_id": motorcycleID, "user_id": userID})
+  if nil != err {
+    return err
+  }
+
+  err = s.notifications.Notify(ctx, tx, ownerID, NotificationFavoriteAdded, map[string]any{
+    "motorcycle_id": motorcycleID,
+    "post_title":    postTitle,
+  })
+  if nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+type FavoriteHandler struct {
+  s *FavoriteService
+}
+
+func NewFavoriteHandler(service *FavoriteService) *FavoriteHandler {
+  return &FavoriteHandler{service}
+}
+
+func (h *FavoriteHandler) Create(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  creation := FavoriteCreation{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&creation)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  err = h.s.Add(r.Context(), userID, creation.MotorcycleID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
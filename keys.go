@@ -0,0 +1,319 @@
+package main
+
+import (
+  "crypto"
+  "crypto/ed25519"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/sha256"
+  "crypto/x509"
+  "encoding/base64"
+  "encoding/json"
+  "encoding/pem"
+  "errors"
+  "fmt"
+  "github.com/golang-jwt/jwt/v5"
+  "log/slog"
+  "math/big"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// rsaMinBits is the smallest RSA modulus accepted for signing or verifying.
+const rsaMinBits = 2048
+
+var ErrInvalidToken = newError(ErrUnauthenticated, "invalid_token", "invalid token")
+
+// SigningKey is a key tokens are verified with and, when its private half
+// is known, signed with.
+type SigningKey struct {
+  ID      string
+  Method  jwt.SigningMethod
+  Private crypto.Signer
+  Public  crypto.PublicKey
+}
+
+// JWK is the public half of a key as published in the JWKS, per RFC 7517.
+type JWK struct {
+  KeyType   string `json:"kty"`
+  KeyID     string `json:"kid"`
+  Use       string `json:"use"`
+  Algorithm string `json:"alg"`
+  Curve     string `json:"crv,omitempty"`
+  X         string `json:"x,omitempty"`
+  N         string `json:"n,omitempty"`
+  E         string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+  Keys []JWK `json:"keys"`
+}
+
+// newSigningKey wraps a parsed PEM key, which may be an RSA or Ed25519
+// private or public key. Its id is its RFC 7638 thumbprint, so that it does
+// not need to be configured and stays the same across restarts.
+func newSigningKey(key any) (*SigningKey, error) {
+  signingKey := &SigningKey{}
+
+  if signer, ok := key.(crypto.Signer); ok {
+    signingKey.Private = signer
+    key = signer.Public()
+  }
+
+  switch public := key.(type) {
+  case *rsa.PublicKey:
+    if rsaMinBits > public.N.BitLen() {
+      return nil, fmt.Errorf("RSA key of %d bits is shorter than %d", public.N.BitLen(), rsaMinBits)
+    }
+
+    signingKey.Method = jwt.SigningMethodRS256
+  case ed25519.PublicKey:
+    signingKey.Method = jwt.SigningMethodEdDSA
+  default:
+    return nil, fmt.Errorf("unsupported key type %T", key)
+  }
+
+  signingKey.Public = key
+  signingKey.ID = thumbprint(signingKey.JWK())
+
+  return signingKey, nil
+}
+
+// loadSigningKey reads a PEM encoded key from path.
+func loadSigningKey(path string) (*SigningKey, error) {
+  data, err := os.ReadFile(path)
+  if nil != err {
+    return nil, err
+  }
+
+  block, _ := pem.Decode(data)
+  if nil == block {
+    return nil, fmt.Errorf("%s is not PEM encoded", path)
+  }
+
+  var key any
+
+  switch block.Type {
+  case "PRIVATE KEY":
+    key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+  case "RSA PRIVATE KEY":
+    key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+  case "PUBLIC KEY":
+    key, err = x509.ParsePKIXPublicKey(block.Bytes)
+  case "RSA PUBLIC KEY":
+    key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+  default:
+    return nil, fmt.Errorf("%s holds an unsupported %q block", path, block.Type)
+  }
+
+  if nil != err {
+    return nil, fmt.Errorf("%s: %w", path, err)
+  }
+
+  return newSigningKey(key)
+}
+
+// JWK describes the public half of k.
+func (k *SigningKey) JWK() JWK {
+  jwk := JWK{KeyID: k.ID, Use: "sig", Algorithm: k.Method.Alg()}
+
+  switch public := k.Public.(type) {
+  case *rsa.PublicKey:
+    jwk.KeyType = "RSA"
+    jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+    jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+  case ed25519.PublicKey:
+    jwk.KeyType = "OKP"
+    jwk.Curve = "Ed25519"
+    jwk.X = base64.RawURLEncoding.EncodeToString(public)
+  }
+
+  return jwk
+}
+
+// thumbprint computes the RFC 7638 thumbprint of jwk: the digest of its
+// required members, in lexicographic order and without whitespace.
+func thumbprint(jwk JWK) string {
+  var members string
+
+  if "RSA" == jwk.KeyType {
+    members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.KeyType, jwk.N)
+  } else {
+    members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Curve, jwk.KeyType, jwk.X)
+  }
+
+  digest := sha256.Sum256([]byte(members))
+  return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// KeyManager signs the tokens we issue with the current key and verifies
+// them with any of the known ones, so that keys can be rotated: the new key
+// signs while the retired ones keep verifying until their tokens expire.
+type KeyManager struct {
+  signing  *SigningKey
+  keys     map[string]*SigningKey
+  issuer   string
+  audience string
+}
+
+func NewKeyManager(signing *SigningKey, verification []*SigningKey, issuer, audience string) *KeyManager {
+  keys := map[string]*SigningKey{signing.ID: signing}
+  for _, key := range verification {
+    keys[key.ID] = key
+  }
+
+  return &KeyManager{signing, keys, issuer, audience}
+}
+
+// keyManagerFromEnv loads the signing key from the PEM file in
+// JWT_SIGNING_KEY and the keys being rotated out from the comma separated
+// files in JWT_VERIFICATION_KEYS. A signing key is required unless
+// DEVELOPMENT is set, in which case a throwaway one is generated: tokens then
+// do not survive a restart, but sessions do, as they can be refreshed.
+func keyManagerFromEnv() (*KeyManager, error) {
+  var signing *SigningKey
+
+  if path := os.Getenv("JWT_SIGNING_KEY"); "" != path {
+    key, err := loadSigningKey(path)
+    if nil != err {
+      return nil, err
+    }
+
+    if nil == key.Private {
+      return nil, fmt.Errorf("%s holds no private key", path)
+    }
+
+    signing = key
+  } else {
+    if development, _ := strconv.ParseBool(os.Getenv("DEVELOPMENT")); !development {
+      return nil, errors.New("JWT_SIGNING_KEY is not set, set DEVELOPMENT=true to sign with a temporary key")
+    }
+
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    if nil != err {
+      return nil, err
+    }
+
+    if signing, err = newSigningKey(private); nil != err {
+      return nil, err
+    }
+
+    slog.Warn("JWT_SIGNING_KEY is not set, signing tokens with a temporary key")
+  }
+
+  var verification []*SigningKey
+
+  for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+    if path = strings.TrimSpace(path); "" == path {
+      continue
+    }
+
+    key, err := loadSigningKey(path)
+    if nil != err {
+      return nil, err
+    }
+
+    verification = append(verification, key)
+  }
+
+  issuer := os.Getenv("JWT_ISSUER")
+  if "" == issuer {
+    issuer = "noda"
+  }
+
+  audience := os.Getenv("JWT_AUDIENCE")
+  if "" == audience {
+    audience = "motonica"
+  }
+
+  return NewKeyManager(signing, verification, issuer, audience), nil
+}
+
+// Sign issues a token with claims, adding our issuer and audience.
+func (m *KeyManager) Sign(claims jwt.MapClaims) (string, error) {
+  claims["iss"] = m.issuer
+  claims["aud"] = m.audience
+
+  token := jwt.NewWithClaims(m.signing.Method, claims)
+  token.Header["kid"] = m.signing.ID
+
+  signed, err := token.SignedString(m.signing.Private)
+  if nil != err {
+    slog.Error(err.Error())
+    return "", err
+  }
+
+  return signed, nil
+}
+
+// Parse verifies a token we issued for subject and returns its claims. The
+// key is picked by the kid header and must be used with its own algorithm;
+// the issuer, audience and expiry are all required.
+func (m *KeyManager) Parse(token, subject string) (jwt.MapClaims, error) {
+  claims := jwt.MapClaims{}
+
+  _, err := jwt.ParseWithClaims(token, claims,
+    func(t *jwt.Token) (any, error) {
+      id, _ := t.Header["kid"].(string)
+
+      key, ok := m.keys[id]
+      if !ok {
+        return nil, fmt.Errorf("unknown key id %q", id)
+      }
+
+      if key.Method.Alg() != t.Method.Alg() {
+        return nil, fmt.Errorf("key %q does not sign with %s", id, t.Method.Alg())
+      }
+
+      return key.Public, nil
+    },
+    jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+    jwt.WithIssuer(m.issuer),
+    jwt.WithAudience(m.audience),
+    jwt.WithSubject(subject),
+    jwt.WithExpirationRequired(),
+    jwt.WithIssuedAt())
+  if nil != err {
+    return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+  }
+
+  return claims, nil
+}
+
+// JWKS lists the public keys tokens may be verified with.
+func (m *KeyManager) JWKS() JWKSet {
+  set := JWKSet{Keys: make([]JWK, 0, len(m.keys))}
+
+  set.Keys = append(set.Keys, m.signing.JWK())
+  for id, key := range m.keys {
+    if m.signing.ID != id {
+      set.Keys = append(set.Keys, key.JWK())
+    }
+  }
+
+  return set
+}
+
+type KeyHandler struct {
+  m *KeyManager
+}
+
+func NewKeyHandler(manager *KeyManager) *KeyHandler {
+  return &KeyHandler{manager}
+}
+
+func (h *KeyHandler) GetJWKS(w http.ResponseWriter, r *http.Request) {
+  response, err := json.Marshal(h.m.JWKS())
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/jwk-set+json")
+  w.Header().Set("Cache-Control", "public, max-age=300")
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
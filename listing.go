@@ -0,0 +1,115 @@
+package main
+
+import (
+  "encoding/json"
+  "log/slog"
+  "net/http"
+  "strconv"
+)
+
+// Listing is a motorcycle as buyers see it: with its seller's public
+// profile and, when the seller chose to show them, their contact details.
+type Listing struct {
+  *Motorcycle
+  Seller  *PublicUser     `json:"seller"`
+  Contact *ListingContact `json:"contact,omitempty"`
+}
+
+type ListingHandler struct {
+  motorcycles *MotorcycleService
+  users       *UserService
+}
+
+func NewListingHandler(motorcycles *MotorcycleService, users *UserService) *ListingHandler {
+  return &ListingHandler{motorcycles, users}
+}
+
+// Get lists the catalogue: active listings narrowed down by the filters
+// statistics and the stream take too. Anyone may browse it; signed-in users
+// also see which listings are their favorites or their own.
+func (h *ListingHandler) Get(w http.ResponseWriter, r *http.Request) {
+  filter, err := NewMotorcycleFilter(r.URL.Query())
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidQuery)
+    return
+  }
+
+  page := 1
+
+  if pageStr := r.URL.Query().Get("page"); "" != pageStr {
+    page, err = strconv.Atoi(pageStr)
+    if nil != err {
+      slog.Error(err.Error())
+      writeError(w, r, ErrInvalidQuery)
+      return
+    }
+  }
+
+  motorcycles, err := h.motorcycles.Search(r.Context(), filter, page)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  if principal := principalFrom(r.Context()); nil != principal {
+    if err = h.motorcycles.Personalise(r.Context(), principal.UserID, motorcycles); nil != err {
+      writeError(w, r, err)
+      return
+    }
+  }
+
+  response, err := json.Marshal(motorcycles)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *ListingHandler) GetByID(w http.ResponseWriter, r *http.Request) {
+  motorcycleID, err := strconv.Atoi(r.PathValue("motorcycle_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  motorcycle, err := h.motorcycles.GetByID(r.Context(), motorcycleID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  if principal := principalFrom(r.Context()); nil != principal {
+    if err = h.motorcycles.Personalise(r.Context(), principal.UserID, []*Motorcycle{motorcycle}); nil != err {
+      writeError(w, r, err)
+      return
+    }
+  }
+
+  seller, err := h.users.GetProfile(r.Context(), motorcycle.OwnerID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  contact, err := h.users.ListingContact(r.Context(), motorcycle.OwnerID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(&Listing{motorcycle, seller, contact})
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+  "log/slog"
+  "math"
+  "strings"
+  "time"
+)
+
+const (
+  loginScopeEmail = "email"
+  loginScopeIP    = "ip"
+)
+
+var ErrInvalidCredentials = newError(ErrUnauthenticated, "invalid_credentials", "invalid credentials")
+
+// LoginThrottledError is returned when a sign in is attempted before the
+// delay imposed by previous failures has passed, or while locked out.
+type LoginThrottledError struct {
+  RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+  return fmt.Sprintf("too many failed sign ins, retry after %s", e.RetryAfter)
+}
+
+func (e *LoginThrottledError) code() string {
+  return "login_throttled"
+}
+
+func (e *LoginThrottledError) retryAfter() time.Duration {
+  return e.RetryAfter
+}
+
+// LoginThrottlePolicy bounds failed sign ins. Failures are counted per email
+// and per client address within Window; from the second failure on, every
+// attempt on the email must wait twice as long as the previous one, up to
+// MaxDelay, and reaching a threshold locks further attempts out for
+// Lockout.
+type LoginThrottlePolicy struct {
+  Window         time.Duration
+  MaxDelay       time.Duration
+  Lockout        time.Duration
+  EmailThreshold int
+  IPThreshold    int
+}
+
+func loginThrottlePolicyFromEnv() LoginThrottlePolicy {
+  return LoginThrottlePolicy{
+    Window:         envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+    MaxDelay:       envDuration("LOGIN_MAX_DELAY", 30*time.Second),
+    Lockout:        envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+    EmailThreshold: envInt("LOGIN_EMAIL_FAILURE_THRESHOLD", 5),
+    IPThreshold:    envInt("LOGIN_IP_FAILURE_THRESHOLD", 50),
+  }
+}
+
+// delay is how long to wait after the last of failures before trying the
+// same email again.
+func (p LoginThrottlePolicy) delay(failures int) time.Duration {
+  if 2 > failures {
+    return 0
+  }
+
+  return exponentialBackoff(time.Second, p.MaxDelay, failures-1)
+}
+
+// LoginThrottle tracks failed sign ins. Failures are keyed by the email as
+// typed, whether or not it has an account, so that being throttled tells
+// nothing about which emails are registered.
+type LoginThrottle struct {
+  db            *sql.DB
+  emails        *EmailService
+  notifications *NotificationService
+  policy        LoginThrottlePolicy
+}
+
+func NewLoginThrottle(db *sql.DB, emails *EmailService, notifications *NotificationService, policy LoginThrottlePolicy) *LoginThrottle {
+  return &LoginThrottle{db, emails, notifications, policy}
+}
+
+func loginEmailKey(email string) string {
+  return strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginIP(ctx context.Context) string {
+  if metadata, ok := requestMetadataFrom(ctx); ok {
+    return metadata.IP
+  }
+
+  return ""
+}
+
+// Check tells whether a sign in with email may be attempted now.
+func (t *LoginThrottle) Check(ctx context.Context, email string) error {
+  getThrottleQuery := `
+  SELECT scope, failures, last_failure_at, locked_until
+    FROM login_throttle
+   WHERE (scope = 'email' AND key = @email)
+      OR (scope = 'ip' AND key = @ip);`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  result, err := t.db.QueryContext(ctx, getThrottleQuery,
+    sql.Named("email", loginEmailKey(email)),
+    sql.Named("ip", loginIP(ctx)))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer result.Close()
+
+  var (
+    now  = time.Now().UTC()
+    wait time.Duration
+  )
+
+  for result.Next() {
+    var (
+      scope         string
+      failures      int
+      lastFailureAt string
+      lockedUntil   sql.NullString
+    )
+
+    if err = result.Scan(&scope, &failures, &lastFailureAt, &lockedUntil); nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    if lockedUntil.Valid {
+      until, err := time.Parse(time.DateTime, lockedUntil.String)
+      if nil == err && until.After(now) {
+        wait = max(wait, until.Sub(now))
+      }
+    }
+
+    if loginScopeEmail == scope {
+      last, err := time.Parse(time.DateTime, lastFailureAt)
+      if nil == err && now.Sub(last) < t.policy.Window {
+        wait = max(wait, last.Add(t.policy.delay(failures)).Sub(now))
+      }
+    }
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if 0 < wait {
+    return &LoginThrottledError{RetryAfter: wait}
+  }
+
+  return nil
+}
+
+// Fail records a failed sign in with email. When it locks the account of
+// userID out, which is zero for unknown emails, its owner is told.
+func (t *LoginThrottle) Fail(ctx context.Context, email string, userID int) error {
+  tx, err := t.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  recordFailureQuery := `
+  INSERT INTO login_throttle (scope, key, failures, last_failure_at)
+                      VALUES (@scope, @key, 1, @now)
+      ON CONFLICT (scope, key)
+      DO UPDATE SET failures = CASE WHEN last_failure_at < @window_start THEN 1 ELSE failures + 1 END,
+                    last_failure_at = @now
+   RETURNING failures;`
+
+  lockQuery := `
+  UPDATE login_throttle
+     SET failures = 0,
+         locked_until = @locked_until
+   WHERE scope = @scope
+     AND key = @key;`
+
+  getUserQuery := `
+  SELECT email, first_name, locale
+    FROM "user"
+   WHERE id = $1;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    now         = time.Now().UTC()
+    lockedUntil = now.Add(t.policy.Lockout)
+    emailLocked bool
+  )
+
+  for _, throttle := range []struct {
+    scope, key string
+    threshold  int
+  }{
+    {loginScopeEmail, loginEmailKey(email), t.policy.EmailThreshold},
+    {loginScopeIP, loginIP(ctx), t.policy.IPThreshold},
+  } {
+    if "" == throttle.key {
+      continue
+    }
+
+    var failures int
+
+    err = tx.QueryRowContext(ctx, recordFailureQuery,
+      sql.Named("scope", throttle.scope),
+      sql.Named("key", throttle.key),
+      sql.Named("now", now.Format(time.DateTime)),
+      sql.Named("window_start", now.Add(-t.policy.Window).Format(time.DateTime))).
+      Scan(&failures)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    if throttle.threshold > failures {
+      continue
+    }
+
+    _, err = tx.ExecContext(ctx, lockQuery,
+      sql.Named("scope", throttle.scope),
+      sql.Named("key", throttle.key),
+      sql.Named("locked_until", lockedUntil.Format(time.DateTime)))
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    slog.Warn(fmt.Sprintf("locked sign ins for %s %s out until %s", throttle.scope, throttle.key, lockedUntil.Format(time.DateTime)))
+
+    emailLocked = emailLocked || loginScopeEmail == throttle.scope
+  }
+
+  if emailLocked && 0 != userID {
+    var address, firstName, locale string
+
+    err = tx.QueryRowContext(ctx, getUserQuery, userID).Scan(&address, &firstName, &locale)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    data := map[string]any{
+      "locked_until": lockedUntil.Format(time.DateTime),
+      "ip":           loginIP(ctx),
+    }
+
+    err = t.notifications.Notify(ctx, tx, userID, NotificationAccountLocked, data)
+    if nil != err {
+      return err
+    }
+
+    err = t.emails.Enqueue(ctx, tx, address, "account_locked", locale, map[string]any{
+      "first_name": firstName,
+      "minutes":    int(math.Round(t.policy.Lockout.Minutes())),
+    })
+    if nil != err {
+      return err
+    }
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Succeed forgets the failures recorded for email.
+func (t *LoginThrottle) Succeed(ctx context.Context, email string) error {
+  clearThrottleQuery := `
+  DELETE
+    FROM login_throttle
+   WHERE scope = 'email'
+     AND key = $1;`
+
+  _, err := t.db.ExecContext(ctx, clearThrottleQuery, loginEmailKey(email))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Purge forgets the failures that no longer delay nor lock anything out.
+func (t *LoginThrottle) Purge(ctx context.Context) error {
+  purgeThrottleQuery := `
+  DELETE
+    FROM login_throttle
+   WHERE last_failure_at < @window_start
+     AND (locked_until IS NULL OR locked_until < @now);`
+
+  now := time.Now().UTC()
+
+  _, err := t.db.ExecContext(ctx, purgeThrottleQuery,
+    sql.Named("now", now.Format(time.DateTime)),
+    sql.Named("window_start", now.Add(-t.policy.Window).Format(time.DateTime)))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
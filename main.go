@@ -2,14 +2,17 @@ package main
 
 import (
   "context"
+  "crypto/rand"
+  "crypto/sha256"
   "database/sql"
-  "github.com/golang-jwt/jwt/v5"
+  "encoding/hex"
   _ "github.com/mattn/go-sqlite3"
   "log"
   "log/slog"
   "net"
   "net/http"
   "os"
+  "strconv"
   "strings"
   "time"
 )
@@ -23,43 +26,193 @@ func setHeader(key, value string) func(http.Handler) http.Handler {
   }
 }
 
-func withAuthorization(next http.HandlerFunc) http.HandlerFunc {
-  secret := os.Getenv("JWT_SECRET")
-  if "" == secret {
-    secret = "default secret"
+// randomHex returns n cryptographically random bytes, hex encoded. It
+// backs tokens, keys and secrets, so it panics rather than hand out a
+// predictable value if the system's random source fails.
+func randomHex(n int) string {
+  b := make([]byte, n)
+  if _, err := rand.Read(b); nil != err {
+    panic("could not read random bytes: " + err.Error())
   }
 
-  return func(w http.ResponseWriter, r *http.Request) {
-    authorization := r.Header.Get("Authorization")
-    if "" == authorization {
-      w.Header().Set("WWW-Authenticate", "Bearer realm=\"access to system\"")
-      w.WriteHeader(http.StatusUnauthorized)
-      return
+  return hex.EncodeToString(b)
+}
+
+// hashToken is how secrets handed out to clients, such as one-time tokens,
+// are stored: only their SHA-256 digest is kept.
+func hashToken(token string) string {
+  digest := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(digest[:])
+}
+
+type requestMetadata struct {
+  ID        string
+  IP        string
+  UserAgent string
+}
+
+type requestMetadataKey struct{}
+
+func requestMetadataFrom(ctx context.Context) (*requestMetadata, bool) {
+  metadata, ok := ctx.Value(requestMetadataKey{}).(*requestMetadata)
+  return metadata, ok
+}
+
+// trustedProxiesFromEnv parses TRUSTED_PROXIES, a comma separated list of
+// addresses and CIDR ranges of the proxies in front of the server.
+func trustedProxiesFromEnv() []*net.IPNet {
+  proxies := make([]*net.IPNet, 0)
+
+  for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+    value = strings.TrimSpace(value)
+    if "" == value {
+      continue
     }
 
-    tokenStr := strings.Split(authorization, " ")[1]
-    token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) { return []byte(secret), nil })
+    if !strings.Contains(value, "/") {
+      if ip := net.ParseIP(value); nil != ip && nil != ip.To4() {
+        value += "/32"
+      } else {
+        value += "/128"
+      }
+    }
+
+    _, network, err := net.ParseCIDR(value)
     if nil != err {
-      slog.Error(err.Error())
-      w.WriteHeader(http.StatusInternalServerError)
-      return
+      slog.Error("invalid proxy in TRUSTED_PROXIES: " + err.Error())
+      continue
     }
 
-    if !token.Valid {
-      w.WriteHeader(http.StatusInternalServerError)
-      return
+    proxies = append(proxies, network)
+  }
+
+  return proxies
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+  for _, network := range trustedProxies {
+    if network.Contains(ip) {
+      return true
     }
+  }
 
-    claims := token.Claims.(jwt.MapClaims)
-    userID := claims["user_id"].(float64)
+  return false
+}
 
-    ctx := context.WithValue(r.Context(), "user_id", int(userID))
-    r = r.Clone(ctx)
+// clientIP is the address of the client behind r. X-Forwarded-For is only
+// believed when the request comes through a trusted proxy, and then only up
+// to the first address, from the right, that is not one.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if nil != err {
+    host = r.RemoteAddr
+  }
 
-    next.ServeHTTP(w, r)
+  ip := net.ParseIP(host)
+  if nil == ip || !isTrustedProxy(ip, trustedProxies) {
+    return host
+  }
+
+  forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+  for i := len(forwarded) - 1; 0 <= i; i-- {
+    hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+    if nil == hop {
+      break
+    }
+
+    host = hop.String()
+
+    if !isTrustedProxy(hop, trustedProxies) {
+      break
+    }
+  }
+
+  return host
+}
+
+// newRequestMetadata returns the middleware that tags every request with an
+// id, reusing the one sent by the client in X-Request-ID when there is one,
+// its client address and user agent.
+func newRequestMetadata(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      requestID := r.Header.Get("X-Request-ID")
+      if "" == requestID || 64 < len(requestID) {
+        requestID = randomHex(16)
+      }
+
+      w.Header().Set("X-Request-ID", requestID)
+
+      metadata := &requestMetadata{ID: requestID, IP: clientIP(r, trustedProxies), UserAgent: r.UserAgent()}
+
+      ctx := context.WithValue(r.Context(), requestMetadataKey{}, metadata)
+      next.ServeHTTP(w, r.WithContext(ctx))
+    })
   }
 }
 
+// envDuration reads a duration such as "90s" or "24h" from the environment,
+// falling back when the variable is unset or malformed.
+func envDuration(key string, fallback time.Duration) time.Duration {
+  value := os.Getenv(key)
+  if "" == value {
+    return fallback
+  }
+
+  d, err := time.ParseDuration(value)
+  if nil != err {
+    slog.Error("invalid duration in " + key + ": " + err.Error())
+    return fallback
+  }
+
+  return d
+}
+
+// envInt reads a positive integer from the environment, falling back when
+// the variable is unset or malformed.
+func envInt(key string, fallback int) int {
+  value := os.Getenv(key)
+  if "" == value {
+    return fallback
+  }
+
+  n, err := strconv.Atoi(value)
+  if nil != err || 1 > n {
+    slog.Error("invalid positive integer in " + key)
+    return fallback
+  }
+
+  return n
+}
+
+// runPeriodically calls job every interval until ctx is done. Failures are
+// logged by the job itself, so the next run simply tries again.
+func runPeriodically(ctx context.Context, interval time.Duration, job func(context.Context) error) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      job(ctx)
+    }
+  }
+}
+
+// exponentialBackoff is the delay before attempt number attempts + 1 of a
+// job retried after base, doubling on every failure up to limit.
+func exponentialBackoff(base, limit time.Duration, attempts int) time.Duration {
+  backoff := base
+  for i := 1; i < attempts && backoff < limit; i++ {
+    backoff *= 2
+  }
+
+  return min(backoff, limit)
+}
+
 func with(mux *http.ServeMux, middlewares ...func(http.Handler) http.Handler) http.Handler {
   var h http.Handler = mux
 
@@ -87,26 +240,174 @@ func main() {
     log.Fatalf("could not ping database: %v", err)
   }
 
+  if err = migrate(context.Background(), db); nil != err {
+    log.Fatalf("could not migrate database: %v", err)
+  }
+
+  passwordPolicy := passwordPolicyFromEnv()
+
   mux := http.NewServeMux()
 
-  userService := NewUserService(db)
-  userHandler := NewUserHandler(userService)
+  deletionGracePeriod := envDuration("DELETION_GRACE_PERIOD", 30*24*time.Hour)
+  purgeInterval := envDuration("PURGE_INTERVAL", time.Hour)
+
+  auditService := NewAuditService(db)
+  auditHandler := NewAuditHandler(auditService)
+
+  webhookService := NewWebhookService(db, publicHTTPClient(10*time.Second))
+  webhookHandler := NewWebhookHandler(webhookService)
+
+  emailService := NewEmailService(db, emailSenderFromEnv(), envDuration("EMAIL_OUTBOX_RETENTION", 30*24*time.Hour))
+
+  keyManager, err := keyManagerFromEnv()
+  if nil != err {
+    log.Fatalf("could not load signing keys: %v", err)
+  }
+
+  keyHandler := NewKeyHandler(keyManager)
+
+  sessionService := NewSessionService(db, keyManager, envDuration("ACCESS_TOKEN_TTL", 15*time.Minute), envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour))
+  sessionHandler := NewSessionHandler(sessionService)
+
+  verificationSecret, err := emailVerificationSecret()
+  if nil != err {
+    log.Fatalf("could not load the email verification secret: %v", err)
+  }
+
+  emailVerificationService := NewEmailVerificationService(db, auditService, emailService, verificationSecret, emailVerificationPolicyFromEnv())
+  emailVerificationHandler := NewEmailVerificationHandler(emailVerificationService)
+
+  passwordResetService := NewPasswordResetService(db, auditService, emailService, sessionService, passwordPolicy, envDuration("PASSWORD_RESET_TTL", time.Hour), passwordResetURLFromEnv())
+  passwordResetHandler := NewPasswordResetHandler(passwordResetService)
+
+  notificationService := NewNotificationService(db)
+  notificationHandler := NewNotificationHandler(notificationService)
+
+  listingBroker := NewListingBroker(256)
+
+  loginThrottle := NewLoginThrottle(db, emailService, notificationService, loginThrottlePolicyFromEnv())
 
-  mux.HandleFunc("POST /signup", userHandler.SignUp)
-  mux.HandleFunc("POST /login", userHandler.SignIn)
+  totpKey, err := totpEncryptionKey()
+  if nil != err {
+    log.Fatalf("could not load the TOTP encryption key: %v", err)
+  }
+
+  twoFactorService := NewTwoFactorService(db, auditService, sessionService, loginThrottle, totpKey, "Motonica")
+  twoFactorHandler := NewTwoFactorHandler(twoFactorService)
+
+  userService := NewUserService(db, auditService, webhookService, emailService, emailVerificationService, listingBroker, sessionService, loginThrottle, twoFactorService, passwordPolicy, deletionGracePeriod)
+  userHandler := NewUserHandler(userService, notificationService)
+
+  apiKeyService := NewAPIKeyService(db, auditService)
+  apiKeyHandler := NewAPIKeyHandler(apiKeyService)
+
+  authenticator := NewAuthenticator(sessionService, apiKeyService)
+  withAuthorization := authenticator.Require
+  withOptionalAuthorization := authenticator.Optional
+
+  rateLimitStore := NewMemoryRateLimitStore()
+  limit := NewRateLimiter(rateLimitStore).Limit
+
+  mux.HandleFunc("GET /.well-known/jwks.json", keyHandler.GetJWKS)
+  mux.HandleFunc("POST /signup", limit("signup", RateLimit{5, time.Hour}, userHandler.SignUp))
+  mux.HandleFunc("POST /login", limit("login", RateLimit{20, time.Minute}, userHandler.SignIn))
+  mux.HandleFunc("POST /login/2fa", limit("login_2fa", RateLimit{20, time.Minute}, twoFactorHandler.SignIn))
+  mux.HandleFunc("POST /token/refresh", limit("token_refresh", RateLimit{30, time.Minute}, sessionHandler.Refresh))
+  mux.HandleFunc("POST /logout", withAuthorization(sessionHandler.Logout))
+  mux.HandleFunc("GET /me/sessions", withAuthorization(sessionHandler.Get))
+  mux.HandleFunc("DELETE /me/sessions", withAuthorization(sessionHandler.DeleteOthers))
+  mux.HandleFunc("DELETE /me/sessions/{session_id}", withAuthorization(sessionHandler.Delete))
+  mux.HandleFunc("POST /restore", limit("restore", RateLimit{10, time.Hour}, userHandler.Restore))
+  mux.HandleFunc("POST /verify-email", limit("verify_email", RateLimit{20, time.Minute}, emailVerificationHandler.Verify))
+  mux.HandleFunc("POST /password/forgot", limit("password_forgot", RateLimit{5, time.Hour}, passwordResetHandler.Forgot))
+  mux.HandleFunc("POST /password/reset", limit("password_reset", RateLimit{10, time.Hour}, passwordResetHandler.Reset))
+  mux.HandleFunc("POST /me/verify-email/resend", withAuthorization(limit("verify_email_resend", RateLimit{5, time.Hour}, emailVerificationHandler.Resend)))
 
   mux.HandleFunc("GET /me", withAuthorization(userHandler.GetMe))
   mux.HandleFunc("PATCH /me", withAuthorization(userHandler.UpdateMe))
   mux.HandleFunc("DELETE /me", withAuthorization(userHandler.DeleteMe))
+  mux.HandleFunc("POST /me/password", withAuthorization(limit("password_change", RateLimit{10, time.Hour}, userHandler.ChangePassword)))
+  mux.HandleFunc("POST /me/2fa/totp", withAuthorization(twoFactorHandler.Enrol))
+  mux.HandleFunc("POST /me/2fa/totp/confirm", withAuthorization(limit("totp_confirm", RateLimit{10, time.Minute}, twoFactorHandler.Confirm)))
+  mux.HandleFunc("DELETE /me/2fa/totp", withAuthorization(limit("totp_disable", RateLimit{10, time.Minute}, twoFactorHandler.Disable)))
+  mux.HandleFunc("POST /me/api-keys", withAuthorization(limit("api_key_create", RateLimit{10, time.Hour}, apiKeyHandler.Create)))
+  mux.HandleFunc("GET /me/api-keys", withAuthorization(apiKeyHandler.Get))
+  mux.HandleFunc("DELETE /me/api-keys/{api_key_id}", withAuthorization(apiKeyHandler.Delete))
 
   mux.HandleFunc("GET /users", withAuthorization(userHandler.Get))
   mux.HandleFunc("GET /users/{user_id}", withAuthorization(userHandler.GetByID))
 
-  motorcycleService := NewMotorcycleService(db)
+  valuationService := NewValuationService(db)
+  valuationHandler := NewValuationHandler(valuationService)
+
+  mux.HandleFunc("POST /valuations", withOptionalAuthorization(limit("valuations", RateLimit{30, time.Minute}, valuationHandler.Create), ScopeMotorcyclesRead))
+
+  listingExpiryService := NewListingExpiryService(db, auditService, webhookService, notificationService, emailVerificationService, listingBroker, listingTTLFromEnv(), envDuration("LISTING_EXPIRY_REMINDER", 72*time.Hour))
+  listingExpiryHandler := NewListingExpiryHandler(listingExpiryService)
+
+  motorcycleService := NewMotorcycleService(db, auditService, webhookService, valuationService, listingExpiryService, emailVerificationService, listingBroker, deletionGracePeriod)
   motorcycleHandler := NewMotorcycleHandler(motorcycleService)
 
-  mux.HandleFunc("POST /me/motorcycles", withAuthorization(motorcycleHandler.Create))
-  mux.HandleFunc("GET /me/motorcycles", withAuthorization(motorcycleHandler.Get))
+  mux.HandleFunc("POST /me/motorcycles", withAuthorization(limit("motorcycle_create", RateLimit{30, time.Hour}, motorcycleHandler.Create), ScopeMotorcyclesWrite))
+  mux.HandleFunc("GET /me/motorcycles", withAuthorization(motorcycleHandler.Get, ScopeMotorcyclesRead))
+  mux.HandleFunc("PATCH /me/motorcycles/{motorcycle_id}", withAuthorization(motorcycleHandler.Update, ScopeMotorcyclesWrite))
+  mux.HandleFunc("DELETE /me/motorcycles/{motorcycle_id}", withAuthorization(motorcycleHandler.Delete, ScopeMotorcyclesWrite))
+  mux.HandleFunc("POST /me/motorcycles/{motorcycle_id}/sold", withAuthorization(motorcycleHandler.MarkSold, ScopeMotorcyclesWrite))
+  mux.HandleFunc("POST /me/motorcycles/{motorcycle_id}/restore", withAuthorization(motorcycleHandler.Restore, ScopeMotorcyclesWrite))
+  mux.HandleFunc("POST /me/motorcycles/{motorcycle_id}/renew", withAuthorization(listingExpiryHandler.Renew, ScopeMotorcyclesWrite))
+
+  listingStreamHandler := NewListingStreamHandler(listingBroker)
+
+  mux.HandleFunc("GET /motorcycles/stream", listingStreamHandler.Stream)
+
+  listingHandler := NewListingHandler(motorcycleService, userService)
+
+  mux.HandleFunc("GET /motorcycles", withOptionalAuthorization(listingHandler.Get, ScopeMotorcyclesRead))
+  mux.HandleFunc("GET /motorcycles/{motorcycle_id}", withOptionalAuthorization(listingHandler.GetByID, ScopeMotorcyclesRead))
+
+  contactRevealService := NewContactRevealService(db, envInt("CONTACT_REVEAL_DAILY_QUOTA", 20))
+  contactRevealHandler := NewContactRevealHandler(contactRevealService)
+
+  mux.HandleFunc("POST /motorcycles/{motorcycle_id}/contact", withAuthorization(limit("contact_reveal", RateLimit{30, time.Minute}, contactRevealHandler.Create)))
+
+  dataExportService := NewDataExportService(db, auditService, notificationService, publicHTTPClient(30*time.Second), dataExportDirFromEnv(), envDuration("DATA_EXPORT_TTL", 7*24*time.Hour))
+  dataExportHandler := NewDataExportHandler(dataExportService)
+
+  mux.HandleFunc("POST /me/export", withAuthorization(limit("data_export", RateLimit{3, 24 * time.Hour}, dataExportHandler.Create)))
+  mux.HandleFunc("GET /me/export/{export_id}", withAuthorization(dataExportHandler.Get))
+
+  favoriteService := NewFavoriteService(db, webhookService, notificationService)
+  favoriteHandler := NewFavoriteHandler(favoriteService)
+
+  mux.HandleFunc("POST /me/motorcycles/favorites", withAuthorization(limit("favorite_create", RateLimit{60, time.Minute}, favoriteHandler.Create)))
+
+  mux.HandleFunc("GET /me/notifications", withAuthorization(notificationHandler.Get))
+  mux.HandleFunc("POST /me/notifications/read", withAuthorization(notificationHandler.MarkRead))
+
+  mux.HandleFunc("POST /me/webhooks", withAuthorization(limit("webhook_create", RateLimit{20, time.Hour}, webhookHandler.Create), ScopeWebhooksWrite))
+  mux.HandleFunc("GET /me/webhooks", withAuthorization(webhookHandler.Get, ScopeWebhooksRead))
+  mux.HandleFunc("DELETE /me/webhooks/{webhook_id}", withAuthorization(webhookHandler.Delete, ScopeWebhooksWrite))
+  mux.HandleFunc("GET /me/webhooks/{webhook_id}/deliveries", withAuthorization(webhookHandler.GetDeliveries, ScopeWebhooksRead))
+  mux.HandleFunc("POST /me/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver", withAuthorization(limit("webhook_redeliver", RateLimit{30, time.Hour}, webhookHandler.Redeliver), ScopeWebhooksWrite))
+
+  mux.HandleFunc("GET /audit", withAuthorization(withRole("admin", auditHandler.Get)))
+
+  statsService := NewStatsService(db, envDuration("STATS_CACHE_TTL", time.Minute))
+  statsHandler := NewStatsHandler(statsService)
+
+  mux.HandleFunc("GET /stats/motorcycles", withAuthorization(statsHandler.GetMotorcycles))
+
+  go runPeriodically(context.Background(), purgeInterval, motorcycleService.Purge)
+  go runPeriodically(context.Background(), purgeInterval, userService.Purge)
+  go runPeriodically(context.Background(), purgeInterval, sessionService.Purge)
+  go runPeriodically(context.Background(), purgeInterval, loginThrottle.Purge)
+  go runPeriodically(context.Background(), purgeInterval, dataExportService.Purge)
+  go runPeriodically(context.Background(), purgeInterval, emailService.Purge)
+  go runPeriodically(context.Background(), time.Minute, rateLimitStore.Purge)
+  go runPeriodically(context.Background(), envDuration("LISTING_EXPIRY_SWEEP_INTERVAL", 15*time.Minute), listingExpiryService.Sweep)
+  go runPeriodically(context.Background(), envDuration("WEBHOOK_DELIVERY_INTERVAL", 10*time.Second), webhookService.Deliver)
+  go runPeriodically(context.Background(), envDuration("EMAIL_DELIVERY_INTERVAL", 10*time.Second), emailService.Deliver)
+  go runPeriodically(context.Background(), envDuration("DATA_EXPORT_INTERVAL", 30*time.Second), dataExportService.Build)
 
   port := os.Getenv("PORT")
 
@@ -117,7 +418,7 @@ func main() {
 
   defer listener.Close()
 
-  h := with(mux, setHeader("Content-Type", "application/json"))
+  h := with(mux, setHeader("Content-Type", "application/json"), newRequestMetadata(trustedProxiesFromEnv()))
 
   server := http.Server{
     Addr:              "",
@@ -0,0 +1,308 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+  "log/slog"
+)
+
+// migrations bring a database created from an older database.sql up to
+// date. A database's version is the number of migrations it went through,
+// kept in its user_version; database.sql sets it for new databases, so
+// every change to the schema there comes with a migration here.
+var migrations = []string{`
+  ALTER TABLE "user" ADD COLUMN "deleted_at" timestamptz DEFAULT NULL;
+  ALTER TABLE "motorcycle" ADD COLUMN "deleted_at" timestamptz DEFAULT NULL;`, `
+  ALTER TABLE "user" ADD COLUMN "role" VARCHAR(16) NOT NULL DEFAULT 'user';
+
+  CREATE TABLE IF NOT EXISTS "audit_log"
+  (
+    "id"          INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "actor_id"    INTEGER              DEFAULT NULL,
+    "action"      VARCHAR(32) NOT NULL,
+    "entity_type" VARCHAR(32) NOT NULL,
+    "entity_id"   INTEGER     NOT NULL,
+    "changes"     TEXT        NOT NULL DEFAULT '{}',
+    "request_id"  VARCHAR(64)          DEFAULT NULL,
+    "ip"          VARCHAR(64)          DEFAULT NULL,
+    "created_at"  timestamptz NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "audit_log_entity_idx" ON "audit_log" ("entity_type", "entity_id");
+  CREATE INDEX IF NOT EXISTS "audit_log_actor_idx" ON "audit_log" ("actor_id");`, `
+  -- ADD COLUMN cannot default renewed_at to current_timestamp, so the table
+  -- is rebuilt; existing listings are renewed as of the migration.
+  CREATE TABLE IF NOT EXISTS "motorcycle_new"
+  (
+    "id"          INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "owner_id"    INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "post_title"  VARCHAR(512) NOT NULL DEFAULT 'Untitled',
+    "price"       FLOAT        NOT NULL DEFAULT 0.0,
+    "type"        VARCHAR(32)  NOT NULL,
+    "mileage"     INTEGER      NOT NULL DEFAULT 0,
+    "brand"       VARCHAR(128) NOT NULL DEFAULT 'Unknown',
+    "model"       VARCHAR(128) NOT NULL DEFAULT 'Unknown',
+    "year"        INT          NOT NULL,
+    "engine"      VARCHAR(128) NOT NULL DEFAULT 'Unknown',
+    "color"       VARCHAR(32)  NOT NULL,
+    "description" VARCHAR(512) NOT NULL DEFAULT 'No description',
+    "location"    VARCHAR(512) NOT NULL DEFAULT 'Unknown',
+    "status"      VARCHAR(16)  NOT NULL DEFAULT 'active',
+    "renewed_at"  timestamptz  NOT NULL DEFAULT current_timestamp,
+    "expires_at"  timestamptz           DEFAULT NULL,
+    "reminded_at" timestamptz           DEFAULT NULL,
+    "created_at"  timestamptz  NOT NULL DEFAULT current_timestamp,
+    "updated_at"  timestamptz  NOT NULL DEFAULT current_timestamp,
+    "deleted_at"  timestamptz           DEFAULT NULL
+  );
+
+  INSERT INTO "motorcycle_new" (id, owner_id, post_title, price, type, mileage, brand, model, year, engine, color, description, location, created_at, updated_at, deleted_at)
+       SELECT id, owner_id, post_title, price, type, mileage, brand, model, year, engine, color, description, location, created_at, updated_at, deleted_at
+         FROM "motorcycle";
+
+  DROP TABLE "motorcycle";
+  ALTER TABLE "motorcycle_new" RENAME TO "motorcycle";`, `
+  CREATE TABLE IF NOT EXISTS "webhook_subscription"
+  (
+    "id"          INTEGER       NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"     INTEGER       NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "url"         VARCHAR(2048) NOT NULL,
+    "secret"      VARCHAR(128)  NOT NULL,
+    "event_types" VARCHAR(512)  NOT NULL,
+    "created_at"  timestamptz   NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE TABLE IF NOT EXISTS "webhook_delivery"
+  (
+    "id"               INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "subscription_id"  INTEGER     NOT NULL REFERENCES "webhook_subscription" ("id") ON DELETE CASCADE,
+    "event_id"         VARCHAR(64) NOT NULL,
+    "event_type"       VARCHAR(64) NOT NULL,
+    "payload"          TEXT        NOT NULL,
+    "status"           VARCHAR(16) NOT NULL DEFAULT 'pending',
+    "attempts"         INTEGER     NOT NULL DEFAULT 0,
+    "next_attempt_at"  timestamptz NOT NULL DEFAULT current_timestamp,
+    "last_status_code" INTEGER              DEFAULT NULL,
+    "last_error"       TEXT                 DEFAULT NULL,
+    "created_at"       timestamptz NOT NULL DEFAULT current_timestamp,
+    "delivered_at"     timestamptz          DEFAULT NULL
+  );
+
+  CREATE INDEX IF NOT EXISTS "webhook_delivery_due_idx" ON "webhook_delivery" ("status", "next_attempt_at");`, `
+  CREATE TABLE IF NOT EXISTS "notification"
+  (
+    "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"    INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "type"       VARCHAR(64) NOT NULL,
+    "data"       TEXT        NOT NULL DEFAULT '{}',
+    "read_at"    timestamptz          DEFAULT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "notification_user_idx" ON "notification" ("user_id", "read_at");`, `
+  ALTER TABLE "user" ADD COLUMN "locale" VARCHAR(8) NOT NULL DEFAULT 'en';
+
+  CREATE TABLE IF NOT EXISTS "email_outbox"
+  (
+    "id"              INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "recipient"       VARCHAR(255) NOT NULL,
+    "template"        VARCHAR(64)  NOT NULL,
+    "locale"          VARCHAR(8)   NOT NULL,
+    "subject"         TEXT         NOT NULL,
+    "text_body"       TEXT                  DEFAULT NULL,
+    "html_body"       TEXT                  DEFAULT NULL,
+    "status"          VARCHAR(16)  NOT NULL DEFAULT 'pending',
+    "attempts"        INTEGER      NOT NULL DEFAULT 0,
+    "next_attempt_at" timestamptz  NOT NULL DEFAULT current_timestamp,
+    "last_error"      TEXT                  DEFAULT NULL,
+    "created_at"      timestamptz  NOT NULL DEFAULT current_timestamp,
+    "sent_at"         timestamptz           DEFAULT NULL
+  );
+
+  CREATE INDEX IF NOT EXISTS "email_outbox_due_idx" ON "email_outbox" ("status", "next_attempt_at");`, `
+  ALTER TABLE "user" ADD COLUMN "email_verified_at" timestamptz DEFAULT NULL;
+
+  CREATE TABLE IF NOT EXISTS "email_verification"
+  (
+    "id"         INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"    INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "email"      VARCHAR(240) NOT NULL,
+    "token_hash" VARCHAR(64)  NOT NULL,
+    "expires_at" timestamptz  NOT NULL,
+    "used_at"    timestamptz           DEFAULT NULL,
+    "created_at" timestamptz  NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "email_verification_user_idx" ON "email_verification" ("user_id");`, `
+  CREATE TABLE IF NOT EXISTS "password_reset"
+  (
+    "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"    INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "token_hash" VARCHAR(64) NOT NULL UNIQUE,
+    "expires_at" timestamptz NOT NULL,
+    "used_at"    timestamptz          DEFAULT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "password_reset_user_idx" ON "password_reset" ("user_id");`, `
+  -- Passwords changed through PATCH /me used to be stored in plain text.
+  -- They are blanked, so those users have to reset them.
+  UPDATE "user"
+     SET password = '',
+         updated_at = current_timestamp
+   WHERE password <> ''
+     AND substr(password, 1, 4) NOT IN ('$2a$', '$2b$', '$2y$');`, `
+  CREATE TABLE IF NOT EXISTS "session"
+  (
+    "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"    INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "expires_at" timestamptz NOT NULL,
+    "revoked_at" timestamptz          DEFAULT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "session_user_idx" ON "session" ("user_id");
+
+  CREATE TABLE IF NOT EXISTS "refresh_token"
+  (
+    "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "session_id" INTEGER     NOT NULL REFERENCES "session" ("id") ON DELETE CASCADE,
+    "token_hash" VARCHAR(64) NOT NULL UNIQUE,
+    "used_at"    timestamptz          DEFAULT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "refresh_token_session_idx" ON "refresh_token" ("session_id");`, `
+  -- ADD COLUMN cannot default last_seen_at to current_timestamp, so the
+  -- table is rebuilt; existing sessions were last seen when created.
+  CREATE TABLE IF NOT EXISTS "session_new"
+  (
+    "id"           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"      INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "device_name"  VARCHAR(64)           DEFAULT NULL,
+    "user_agent"   VARCHAR(256)          DEFAULT NULL,
+    "ip"           VARCHAR(45)           DEFAULT NULL,
+    "expires_at"   timestamptz  NOT NULL,
+    "revoked_at"   timestamptz           DEFAULT NULL,
+    "created_at"   timestamptz  NOT NULL DEFAULT current_timestamp,
+    "last_seen_at" timestamptz  NOT NULL DEFAULT current_timestamp
+  );
+
+  INSERT INTO "session_new" (id, user_id, expires_at, revoked_at, created_at, last_seen_at)
+       SELECT id, user_id, expires_at, revoked_at, created_at, created_at
+         FROM "session";
+
+  DROP TABLE "session";
+  ALTER TABLE "session_new" RENAME TO "session";
+
+  CREATE INDEX IF NOT EXISTS "session_user_idx" ON "session" ("user_id");`, `
+  CREATE TABLE IF NOT EXISTS "login_throttle"
+  (
+    "scope"           VARCHAR(8)   NOT NULL,
+    "key"             VARCHAR(240) NOT NULL,
+    "failures"        INTEGER      NOT NULL DEFAULT 0,
+    "last_failure_at" timestamptz  NOT NULL,
+    "locked_until"    timestamptz           DEFAULT NULL,
+    PRIMARY KEY ("scope", "key")
+  );`, `
+  CREATE TABLE IF NOT EXISTS "totp"
+  (
+    "user_id"        INTEGER      NOT NULL PRIMARY KEY REFERENCES "user" ("id") ON DELETE CASCADE,
+    "secret"         VARCHAR(128) NOT NULL,
+    "last_used_step" INTEGER      NOT NULL DEFAULT 0,
+    "confirmed_at"   timestamptz           DEFAULT NULL,
+    "created_at"     timestamptz  NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE TABLE IF NOT EXISTS "recovery_code"
+  (
+    "id"         INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"    INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "code_hash"  VARCHAR(64) NOT NULL,
+    "used_at"    timestamptz          DEFAULT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "recovery_code_user_idx" ON "recovery_code" ("user_id");`, `
+  CREATE TABLE IF NOT EXISTS "api_key"
+  (
+    "id"           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"      INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "name"         VARCHAR(64)  NOT NULL,
+    "prefix"       VARCHAR(16)  NOT NULL,
+    "key_hash"     VARCHAR(64)  NOT NULL UNIQUE,
+    "scopes"       VARCHAR(512) NOT NULL,
+    "last_used_at" timestamptz           DEFAULT NULL,
+    "created_at"   timestamptz  NOT NULL DEFAULT current_timestamp,
+    "revoked_at"   timestamptz           DEFAULT NULL
+  );
+
+  CREATE INDEX IF NOT EXISTS "api_key_user_idx" ON "api_key" ("user_id");`, `
+  ALTER TABLE "user" ADD COLUMN "show_phone_on_listings" BOOLEAN NOT NULL DEFAULT 0;
+  ALTER TABLE "user" ADD COLUMN "show_email_on_listings" BOOLEAN NOT NULL DEFAULT 0;`, `
+  CREATE TABLE IF NOT EXISTS "contact_reveal"
+  (
+    "id"            INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "motorcycle_id" INTEGER     NOT NULL REFERENCES "motorcycle" ("id") ON DELETE CASCADE,
+    "user_id"       INTEGER     NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "created_at"    timestamptz NOT NULL DEFAULT current_timestamp
+  );
+
+  CREATE INDEX IF NOT EXISTS "contact_reveal_user_idx" ON "contact_reveal" ("user_id", "created_at");
+  CREATE INDEX IF NOT EXISTS "contact_reveal_motorcycle_idx" ON "contact_reveal" ("motorcycle_id");
+
+  ALTER TABLE "user" ADD COLUMN "reveal_phone" BOOLEAN NOT NULL DEFAULT 1;
+  ALTER TABLE "user" ADD COLUMN "reveal_email" BOOLEAN NOT NULL DEFAULT 1;`, `
+  CREATE TABLE IF NOT EXISTS "data_export"
+  (
+    "id"           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "user_id"      INTEGER      NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "status"       VARCHAR(16)  NOT NULL DEFAULT 'pending',
+    "path"         VARCHAR(512)          DEFAULT NULL,
+    "size"         INTEGER               DEFAULT NULL,
+    "created_at"   timestamptz  NOT NULL DEFAULT current_timestamp,
+    "completed_at" timestamptz           DEFAULT NULL,
+    "expires_at"   timestamptz           DEFAULT NULL
+  );
+
+  CREATE INDEX IF NOT EXISTS "data_export_user_idx" ON "data_export" ("user_id");
+  CREATE INDEX IF NOT EXISTS "data_export_status_idx" ON "data_export" ("status");`,
+}
+
+// migrate runs the migrations db has not been through yet, each in its own
+// transaction.
+func migrate(ctx context.Context, db *sql.DB) error {
+  var version int
+
+  err := db.QueryRowContext(ctx, `PRAGMA user_version;`).Scan(&version)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for ; version < len(migrations); version++ {
+    tx, err := db.BeginTx(ctx, nil)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    if _, err = tx.ExecContext(ctx, migrations[version]); nil != err {
+      tx.Rollback()
+      return fmt.Errorf("migration %d: %w", version+1, err)
+    }
+
+    if _, err = tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d;`, version+1)); nil != err {
+      tx.Rollback()
+      return fmt.Errorf("migration %d: %w", version+1, err)
+    }
+
+    if err = tx.Commit(); nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+  }
+
+  return nil
+}
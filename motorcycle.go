@@ -4,30 +4,41 @@ import (
   "context"
   "database/sql"
   "encoding/json"
+  "errors"
   "log/slog"
   "net/http"
+  "net/url"
   "strconv"
   "strings"
   "time"
 )
 
+// Motorcycle is a listing. ContactReveals, how many buyers asked for the
+// seller's contact details, is only set for the seller; Favorite and Own are
+// only set when a signed-in user browses the catalogue.
 type Motorcycle struct {
-  ID          int                `json:"id"`
-  OwnerID     int                `json:"owner_id"`
-  PostTitle   string             `json:"post_title"`
-  Price       float32            `json:"price"`
-  Type        string             `json:"type"`
-  Mileage     int64              `json:"mileage"`
-  Brand       string             `json:"brand"`
-  Model       string             `json:"model"`
-  Year        int                `json:"year"`
-  Engine      string             `json:"engine"`
-  Color       string             `json:"color"`
-  Description string             `json:"description"`
-  Location    string             `json:"location"`
-  Images      []*MotorcycleImage `json:"images"`
-  CreatedAt   string             `json:"created_at"`
-  UpdatedAt   string             `json:"updated_at"`
+  ID             int                `json:"id"`
+  OwnerID        int                `json:"owner_id"`
+  PostTitle      string             `json:"post_title"`
+  Price          float32            `json:"price"`
+  Type           string             `json:"type"`
+  Mileage        int64              `json:"mileage"`
+  Brand          string             `json:"brand"`
+  Model          string             `json:"model"`
+  Year           int                `json:"year"`
+  Engine         string             `json:"engine"`
+  Color          string             `json:"color"`
+  Description    string             `json:"description"`
+  Location       string             `json:"location"`
+  Status         string             `json:"status"`
+  ExpiresAt      *string            `json:"expires_at"`
+  Images         []*MotorcycleImage `json:"images"`
+  PriceRating    PriceRating        `json:"price_rating,omitempty"`
+  ContactReveals *int               `json:"contact_reveals,omitempty"`
+  Favorite       *bool              `json:"favorite,omitempty"`
+  Own            *bool              `json:"own,omitempty"`
+  CreatedAt      string             `json:"created_at"`
+  UpdatedAt      string             `json:"updated_at"`
 }
 
 type MotorcycleImage struct {
@@ -37,6 +48,12 @@ type MotorcycleImage struct {
   UpdatedAt string `json:"updated_at"`
 }
 
+const (
+  MotorcycleStatusActive  = "active"
+  MotorcycleStatusExpired = "expired"
+  MotorcycleStatusSold    = "sold"
+)
+
 type MotorcycleCreation struct {
   PostTitle   string  `json:"post_title"`
   Price       float32 `json:"price"`
@@ -51,15 +68,280 @@ type MotorcycleCreation struct {
   Location    string  `json:"location"`
 }
 
+var (
+  motorcycleTypes = []string{
+    "adventure", "cafe racer", "classic", "cruiser", "custom", "enduro", "motocross",
+    "naked", "scooter", "sport", "sport touring", "supermoto", "touring", "trial",
+  }
+
+  motorcycleColors = []string{
+    "beige", "black", "blue", "brown", "gold", "green", "grey", "multicolor",
+    "orange", "pink", "purple", "red", "silver", "white", "yellow",
+  }
+)
+
+const (
+  // motorcycleFirstYear is when the first motorcycle was built.
+  motorcycleFirstYear = 1885
+
+  motorcycleMaxPrice   = 10_000_000
+  motorcycleMaxMileage = 2_000_000
+)
+
+// validate checks c against the columns it is stored in and against what
+// a motorcycle can be. Next year's models are on sale already.
+func (c *MotorcycleCreation) validate() *validator {
+  v := &validator{}
+
+  v.required("post_title", c.PostTitle)
+  v.maxLength("post_title", c.PostTitle, 512)
+  v.floatRange("price", float64(c.Price), 1, motorcycleMaxPrice)
+  v.required("type", c.Type)
+  v.oneOf("type", c.Type, motorcycleTypes)
+  v.intRange("mileage", c.Mileage, 0, motorcycleMaxMileage)
+  v.maxLength("brand", c.Brand, 128)
+  v.maxLength("model", c.Model, 128)
+  v.intRange("year", int64(c.Year), motorcycleFirstYear, int64(time.Now().Year()+1))
+  v.maxLength("engine", c.Engine, 128)
+  v.required("color", c.Color)
+  v.oneOf("color", c.Color, motorcycleColors)
+  v.maxLength("description", c.Description, 512)
+  v.maxLength("location", c.Location, 512)
+
+  return v
+}
+
+type MotorcycleUpdate struct {
+  PostTitle   string  `json:"post_title"`
+  Price       float32 `json:"price"`
+  Type        string  `json:"type"`
+  Mileage     int64   `json:"mileage"`
+  Brand       string  `json:"brand"`
+  Model       string  `json:"model"`
+  Year        int     `json:"year"`
+  Engine      string  `json:"engine"`
+  Color       string  `json:"color"`
+  Description string  `json:"description"`
+  Location    string  `json:"location"`
+}
+
+// validate checks the fields u sets with the same rules as a creation. Zero
+// values leave a field unchanged, so they are not checked.
+func (u *MotorcycleUpdate) validate() *validator {
+  v := &validator{}
+
+  v.maxLength("post_title", u.PostTitle, 512)
+  v.oneOf("type", u.Type, motorcycleTypes)
+  v.intRange("mileage", u.Mileage, 0, motorcycleMaxMileage)
+  v.maxLength("brand", u.Brand, 128)
+  v.maxLength("model", u.Model, 128)
+  v.maxLength("engine", u.Engine, 128)
+  v.oneOf("color", u.Color, motorcycleColors)
+  v.maxLength("description", u.Description, 512)
+  v.maxLength("location", u.Location, 512)
+
+  if 0 != u.Price {
+    v.floatRange("price", float64(u.Price), 1, motorcycleMaxPrice)
+  }
+
+  if 0 != u.Year {
+    v.intRange("year", int64(u.Year), motorcycleFirstYear, int64(time.Now().Year()+1))
+  }
+
+  return v
+}
+
+// MotorcycleFilter holds the catalogue query parameters shared by every
+// endpoint that narrows down listings. Zero values mean "no filter".
+type MotorcycleFilter struct {
+  Brand      string
+  Model      string
+  Type       string
+  Color      string
+  Location   string
+  MinYear    int
+  MaxYear    int
+  MinPrice   float64
+  MaxPrice   float64
+  MaxMileage int64
+}
+
+func NewMotorcycleFilter(query url.Values) (filter *MotorcycleFilter, err error) {
+  filter = &MotorcycleFilter{
+    Brand:    strings.TrimSpace(query.Get("brand")),
+    Model:    strings.TrimSpace(query.Get("model")),
+    Type:     strings.TrimSpace(query.Get("type")),
+    Color:    strings.TrimSpace(query.Get("color")),
+    Location: strings.TrimSpace(query.Get("location")),
+  }
+
+  if v := query.Get("min_year"); "" != v {
+    if filter.MinYear, err = strconv.Atoi(v); nil != err {
+      return nil, err
+    }
+  }
+
+  if v := query.Get("max_year"); "" != v {
+    if filter.MaxYear, err = strconv.Atoi(v); nil != err {
+      return nil, err
+    }
+  }
+
+  if v := query.Get("min_price"); "" != v {
+    if filter.MinPrice, err = strconv.ParseFloat(v, 64); nil != err {
+      return nil, err
+    }
+  }
+
+  if v := query.Get("max_price"); "" != v {
+    if filter.MaxPrice, err = strconv.ParseFloat(v, 64); nil != err {
+      return nil, err
+    }
+  }
+
+  if v := query.Get("max_mileage"); "" != v {
+    if filter.MaxMileage, err = strconv.ParseInt(v, 10, 64); nil != err {
+      return nil, err
+    }
+  }
+
+  return filter, nil
+}
+
+// motorcycleFilterCondition is the SQL counterpart of MotorcycleFilter; it
+// expects the arguments returned by MotorcycleFilter.args.
+const motorcycleFilterCondition = `
+     (@brand = '' OR lower(brand) = lower(@brand))
+     AND (@model = '' OR lower(model) = lower(@model))
+     AND (@type = '' OR lower(type) = lower(@type))
+     AND (@color = '' OR lower(color) = lower(@color))
+     AND (@location = '' OR instr(lower(location), lower(@location)) > 0)
+     AND (0 = @min_year OR year >= @min_year)
+     AND (0 = @max_year OR year <= @max_year)
+     AND (0 = @min_price OR price >= @min_price)
+     AND (0 = @max_price OR price <= @max_price)
+     AND (0 = @max_mileage OR mileage <= @max_mileage)`
+
+func (f *MotorcycleFilter) args() []any {
+  return []any{
+    sql.Named("brand", f.Brand),
+    sql.Named("model", f.Model),
+    sql.Named("type", f.Type),
+    sql.Named("color", f.Color),
+    sql.Named("location", f.Location),
+    sql.Named("min_year", f.MinYear),
+    sql.Named("max_year", f.MaxYear),
+    sql.Named("min_price", f.MinPrice),
+    sql.Named("max_price", f.MaxPrice),
+    sql.Named("max_mileage", f.MaxMileage),
+  }
+}
+
+// key identifies the listings f selects, for caching. Text filters match
+// regardless of case, so they are lowercased.
+func (f *MotorcycleFilter) key() string {
+  return url.Values{
+    "brand":       {strings.ToLower(f.Brand)},
+    "model":       {strings.ToLower(f.Model)},
+    "type":        {strings.ToLower(f.Type)},
+    "color":       {strings.ToLower(f.Color)},
+    "location":    {strings.ToLower(f.Location)},
+    "min_year":    {strconv.Itoa(f.MinYear)},
+    "max_year":    {strconv.Itoa(f.MaxYear)},
+    "min_price":   {strconv.FormatFloat(f.MinPrice, 'f', -1, 64)},
+    "max_price":   {strconv.FormatFloat(f.MaxPrice, 'f', -1, 64)},
+    "max_mileage": {strconv.FormatInt(f.MaxMileage, 10)},
+  }.Encode()
+}
+
+var (
+  ErrMotorcycleNotFound = newError(ErrNotFound, "motorcycle_not_found", "motorcycle not found")
+)
+
+const motorcycleSnapshotQuery = `
+  SELECT id,
+         owner_id,
+         post_title,
+         price,
+         type,
+         mileage,
+         brand,
+         model,
+         year,
+         engine,
+         color,
+         description,
+         location,
+         status,
+         expires_at,
+         deleted_at
+    FROM motorcycle
+   WHERE id = @id;`
+
+// motorcycleSnapshots runs query, which must return the ids of the listings
+// it changes, and snapshots each of them afterwards.
+func motorcycleSnapshots(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]map[string]any, error) {
+  result, err := tx.QueryContext(ctx, query, args...)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  ids := make([]int, 0)
+
+  for result.Next() {
+    var id int
+
+    if err = result.Scan(&id); nil != err {
+      result.Close()
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    ids = append(ids, id)
+  }
+
+  result.Close()
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  snapshots := make([]map[string]any, 0, len(ids))
+
+  for _, id := range ids {
+    after, err := snapshot(ctx, tx, motorcycleSnapshotQuery, sql.Named("id", id))
+    if nil != err {
+      return nil, err
+    }
+
+    snapshots = append(snapshots, after)
+  }
+
+  return snapshots, nil
+}
+
 type MotorcycleService struct {
-  db *sql.DB
+  db                  *sql.DB
+  audit               *AuditService
+  webhooks            *WebhookService
+  valuations          *ValuationService
+  expiry              *ListingExpiryService
+  verifications       *EmailVerificationService
+  listings            *ListingBroker
+  deletionGracePeriod time.Duration
 }
 
-func NewMotorcycleService(db *sql.DB) *MotorcycleService {
-  return &MotorcycleService{db}
+func NewMotorcycleService(db *sql.DB, audit *AuditService, webhooks *WebhookService, valuations *ValuationService, expiry *ListingExpiryService, verifications *EmailVerificationService, listings *ListingBroker, deletionGracePeriod time.Duration) *MotorcycleService {
+  return &MotorcycleService{db, audit, webhooks, valuations, expiry, verifications, listings, deletionGracePeriod}
 }
 
 func (s *MotorcycleService) Create(ctx context.Context, ownerID int, creation *MotorcycleCreation) (insertedID int, err error) {
+  if err = creation.validate().err(); nil != err {
+    return 0, err
+  }
+
   tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
   if nil != err {
     slog.Error(err.Error())
@@ -80,7 +362,8 @@ func (s *MotorcycleService) Create(ctx context.Context, ownerID int, creation *M
                             engine,
                             color,
                             description,
-                            location)
+                            location,
+                            expires_at)
                     VALUES (@owner_id,
                             @post_title,
                             @price,
@@ -92,25 +375,36 @@ func (s *MotorcycleService) Create(ctx context.Context, ownerID int, creation *M
                             @engine,
                             @color,
                             @description,
-                            @location)
+                            @location,
+                            @expires_at)
     RETURNING id;`
 
   ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
   defer cancel()
 
+  if err = s.verifications.RequireVerified(ctx, tx, ownerID); nil != err {
+    return 0, err
+  }
+
+  expiresAt, err := s.expiry.ExpiresAt(ctx, tx, ownerID)
+  if nil != err {
+    return 0, err
+  }
+
   err = tx.QueryRowContext(ctx, createMotorcycleQuery,
     sql.Named("owner_id", ownerID),
     sql.Named("post_title", strings.TrimSpace(creation.PostTitle)),
     sql.Named("price", creation.Price),
-    sql.Named("type", strings.TrimSpace(creation.Type)),
+    sql.Named("type", strings.ToLower(strings.TrimSpace(creation.Type))),
     sql.Named("mileage", creation.Mileage),
     sql.Named("brand", strings.TrimSpace(creation.Brand)),
     sql.Named("model", strings.TrimSpace(creation.Model)),
     sql.Named("year", creation.Year),
     sql.Named("engine", strings.TrimSpace(creation.Engine)),
-    sql.Named("color", strings.TrimSpace(creation.Color)),
+    sql.Named("color", strings.ToLower(strings.TrimSpace(creation.Color))),
     sql.Named("description", strings.TrimSpace(creation.Description)),
-    sql.Named("location", strings.TrimSpace(creation.Location))).
+    sql.Named("location", strings.TrimSpace(creation.Location)),
+    sql.Named("expires_at", expiresAt)).
     Scan(&insertedID)
 
   if nil != err {
@@ -118,11 +412,28 @@ func (s *MotorcycleService) Create(ctx context.Context, ownerID int, creation *M
     return 0, err
   }
 
+  after, err := snapshot(ctx, tx, motorcycleSnapshotQuery, sql.Named("id", insertedID))
+  if nil != err {
+    return 0, err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionCreate, "motorcycle", insertedID, nil, after)
+  if nil != err {
+    return 0, err
+  }
+
+  err = s.webhooks.Enqueue(ctx, tx, ownerID, EventMotorcycleCreated, after)
+  if nil != err {
+    return 0, err
+  }
+
   if err = tx.Commit(); nil != err {
     slog.Error(err.Error())
     return 0, err
   }
 
+  s.listings.Publish(EventMotorcycleCreated, after)
+
   return insertedID, nil
 }
 
@@ -136,7 +447,8 @@ func (s *MotorcycleService) GetFromUser(ctx context.Context, ownerID, page int)
        FROM motorcycle_image mi
   LEFT JOIN motorcycle m
          ON m.id = mi.motorcycle_id  
-      WHERE m.owner_id = $1;`
+      WHERE m.owner_id = $1
+        AND m.deleted_at IS NULL;`
 
   ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
   defer cancel()
@@ -187,10 +499,16 @@ func (s *MotorcycleService) GetFromUser(ctx context.Context, ownerID, page int)
          color,
          description,
          location,
+         status,
+         expires_at,
+         (SELECT count(*)
+            FROM contact_reveal cr
+           WHERE cr.motorcycle_id = motorcycle.id),
          created_at,
          updated_at
     FROM motorcycle
    WHERE owner_id = @owner_id
+     AND deleted_at IS NULL
    ORDER BY created_at DESC
    LIMIT 10
    OFFSET 10 * (@page - 1);`
@@ -230,6 +548,143 @@ func (s *MotorcycleService) GetFromUser(ctx context.Context, ownerID, page int)
       &motorcycle.Color,
       &motorcycle.Description,
       &motorcycle.Location,
+      &motorcycle.Status,
+      &motorcycle.ExpiresAt,
+      &motorcycle.ContactReveals,
+      &motorcycle.CreatedAt,
+      &motorcycle.UpdatedAt,
+    )
+
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    motorcycle.Images = motorcycleImagesDictionary[motorcycle.ID]
+    motorcycles = append(motorcycles, &motorcycle)
+  }
+
+  err = s.valuations.Rate(ctx, motorcycles)
+  if nil != err {
+    return nil, err
+  }
+
+  return motorcycles, nil
+}
+
+// Search returns a page of the active listings matching filter, newest
+// first, as the catalogue shows them.
+func (s *MotorcycleService) Search(ctx context.Context, filter *MotorcycleFilter, page int) (motorcycles []*Motorcycle, err error) {
+  getMotorcyclesQuery := `
+  SELECT id,
+         owner_id,
+         post_title,
+         price,
+         type,
+         mileage,
+         brand,
+         model,
+         year,
+         engine,
+         color,
+         description,
+         location,
+         status,
+         expires_at,
+         created_at,
+         updated_at
+    FROM motorcycle
+   WHERE deleted_at IS NULL
+     AND status = 'active'
+     AND ` + motorcycleFilterCondition + `
+ORDER BY created_at DESC, id DESC
+   LIMIT 10
+  OFFSET 10 * (@page - 1);`
+
+  getMotorcyclesImagesQuery := `
+  SELECT motorcycle_id,
+         id,
+         url,
+         created_at,
+         updated_at
+    FROM motorcycle_image
+   WHERE motorcycle_id IN (SELECT id
+                             FROM motorcycle
+                            WHERE deleted_at IS NULL
+                              AND status = 'active'
+                              AND ` + motorcycleFilterCondition + `
+                         ORDER BY created_at DESC, id DESC
+                            LIMIT 10
+                           OFFSET 10 * (@page - 1));`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  if 0 >= page {
+    page = 1
+  }
+
+  args := append(filter.args(), sql.Named("page", page))
+
+  result, err := s.db.QueryContext(ctx, getMotorcyclesImagesQuery, args...)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  motorcycleImagesDictionary := map[int][]*MotorcycleImage{}
+
+  for result.Next() {
+    var (
+      motorcycleID int
+      image        MotorcycleImage
+    )
+
+    err = result.Scan(&motorcycleID, &image.ID, &image.URL, &image.CreatedAt, &image.UpdatedAt)
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    motorcycleImagesDictionary[motorcycleID] = append(motorcycleImagesDictionary[motorcycleID], &image)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  result, err = s.db.QueryContext(ctx, getMotorcyclesQuery, args...)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  motorcycles = make([]*Motorcycle, 0)
+
+  for result.Next() {
+    var motorcycle Motorcycle
+
+    err = result.Scan(
+      &motorcycle.ID,
+      &motorcycle.OwnerID,
+      &motorcycle.PostTitle,
+      &motorcycle.Price,
+      &motorcycle.Type,
+      &motorcycle.Mileage,
+      &motorcycle.Brand,
+      &motorcycle.Model,
+      &motorcycle.Year,
+      &motorcycle.Engine,
+      &motorcycle.Color,
+      &motorcycle.Description,
+      &motorcycle.Location,
+      &motorcycle.Status,
+      &motorcycle.ExpiresAt,
       &motorcycle.CreatedAt,
       &motorcycle.UpdatedAt,
     )
@@ -243,9 +698,357 @@ func (s *MotorcycleService) GetFromUser(ctx context.Context, ownerID, page int)
     motorcycles = append(motorcycles, &motorcycle)
   }
 
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  err = s.valuations.Rate(ctx, motorcycles)
+  if nil != err {
+    return nil, err
+  }
+
   return motorcycles, nil
 }
 
+// GetByID returns the active listing id, as shown to buyers.
+func (s *MotorcycleService) GetByID(ctx context.Context, id int) (*Motorcycle, error) {
+  getMotorcycleQuery := `
+  SELECT id,
+         owner_id,
+         post_title,
+         price,
+         type,
+         mileage,
+         brand,
+         model,
+         year,
+         engine,
+         color,
+         description,
+         location,
+         status,
+         expires_at,
+         created_at,
+         updated_at
+    FROM motorcycle
+   WHERE id = $1
+     AND status = 'active'
+     AND deleted_at IS NULL;`
+
+  getMotorcycleImagesQuery := `
+  SELECT id,
+         url,
+         created_at,
+         updated_at
+    FROM motorcycle_image
+   WHERE motorcycle_id = $1;`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  motorcycle := new(Motorcycle)
+
+  err := s.db.QueryRowContext(ctx, getMotorcycleQuery, id).Scan(
+    &motorcycle.ID,
+    &motorcycle.OwnerID,
+    &motorcycle.PostTitle,
+    &motorcycle.Price,
+    &motorcycle.Type,
+    &motorcycle.Mileage,
+    &motorcycle.Brand,
+    &motorcycle.Model,
+    &motorcycle.Year,
+    &motorcycle.Engine,
+    &motorcycle.Color,
+    &motorcycle.Description,
+    &motorcycle.Location,
+    &motorcycle.Status,
+    &motorcycle.ExpiresAt,
+    &motorcycle.CreatedAt,
+    &motorcycle.UpdatedAt,
+  )
+
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrMotorcycleNotFound
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  result, err := s.db.QueryContext(ctx, getMotorcycleImagesQuery, id)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  for result.Next() {
+    var image MotorcycleImage
+
+    err = result.Scan(&image.ID, &image.URL, &image.CreatedAt, &image.UpdatedAt)
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    motorcycle.Images = append(motorcycle.Images, &image)
+  }
+
+  err = s.valuations.Rate(ctx, []*Motorcycle{motorcycle})
+  if nil != err {
+    return nil, err
+  }
+
+  return motorcycle, nil
+}
+
+// Personalise flags, for userID, which of motorcycles are their favorites and
+// which are their own listings. The flags stay unset for anonymous requests.
+func (s *MotorcycleService) Personalise(ctx context.Context, userID int, motorcycles []*Motorcycle) error {
+  if 0 == len(motorcycles) {
+    return nil
+  }
+
+  getFavoritesQuery := `
+  SELECT motorcycle_id
+    FROM favorite
+   WHERE user_id = @user_id
+     AND motorcycle_id IN (SELECT value FROM json_each(@motorcycle_ids));`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  ids := make([]int, 0, len(motorcycles))
+  for _, motorcycle := range motorcycles {
+    ids = append(ids, motorcycle.ID)
+  }
+
+  motorcycleIDs, err := json.Marshal(ids)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  result, err := s.db.QueryContext(ctx, getFavoritesQuery, sql.Named("user_id", userID), sql.Named("motorcycle_ids", string(motorcycleIDs)))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer result.Close()
+
+  favorites := make(map[int]bool)
+
+  for result.Next() {
+    var motorcycleID int
+
+    if err = result.Scan(&motorcycleID); nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    favorites[motorcycleID] = true
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, motorcycle := range motorcycles {
+    favorite, own := favorites[motorcycle.ID], userID == motorcycle.OwnerID
+    motorcycle.Favorite, motorcycle.Own = &favorite, &own
+  }
+
+  return nil
+}
+
+// mutate runs query, which must affect exactly the listing id of ownerID,
+// and records the change in the audit log and the webhook queue within the
+// same transaction. Once committed, the change is published to the streams.
+func (s *MotorcycleService) mutate(ctx context.Context, ownerID, id int, action, event, query string, args ...any) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  before, err := snapshot(ctx, tx, motorcycleSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrMotorcycleNotFound
+    }
+
+    return err
+  }
+
+  args = append(args, sql.Named("id", id), sql.Named("owner_id", ownerID))
+
+  result, err := tx.ExecContext(ctx, query, args...)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return ErrMotorcycleNotFound
+  }
+
+  after, err := snapshot(ctx, tx, motorcycleSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, action, "motorcycle", id, before, after)
+  if nil != err {
+    return err
+  }
+
+  err = s.webhooks.Enqueue(ctx, tx, ownerID, event, after)
+  if nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  s.listings.Publish(event, after)
+
+  return nil
+}
+
+func (s *MotorcycleService) Update(ctx context.Context, ownerID, id int, update *MotorcycleUpdate) error {
+  if err := update.validate().err(); nil != err {
+    return err
+  }
+
+  updateMotorcycleQuery := `
+  UPDATE motorcycle
+     SET post_title = coalesce(nullif(@post_title, ''), post_title),
+         price = coalesce(nullif(@price, 0), price),
+         type = coalesce(nullif(@type, ''), type),
+         mileage = coalesce(nullif(@mileage, 0), mileage),
+         brand = coalesce(nullif(@brand, ''), brand),
+         model = coalesce(nullif(@model, ''), model),
+         year = coalesce(nullif(@year, 0), year),
+         engine = coalesce(nullif(@engine, ''), engine),
+         color = coalesce(nullif(@color, ''), color),
+         description = coalesce(nullif(@description, ''), description),
+         location = coalesce(nullif(@location, ''), location),
+         updated_at = current_timestamp
+   WHERE id = @id
+     AND owner_id = @owner_id
+     AND status <> 'sold'
+     AND deleted_at IS NULL;`
+
+  return s.mutate(ctx, ownerID, id, AuditActionUpdate, EventMotorcycleUpdated, updateMotorcycleQuery,
+    sql.Named("post_title", strings.TrimSpace(update.PostTitle)),
+    sql.Named("price", update.Price),
+    sql.Named("type", strings.ToLower(strings.TrimSpace(update.Type))),
+    sql.Named("mileage", update.Mileage),
+    sql.Named("brand", strings.TrimSpace(update.Brand)),
+    sql.Named("model", strings.TrimSpace(update.Model)),
+    sql.Named("year", update.Year),
+    sql.Named("engine", strings.TrimSpace(update.Engine)),
+    sql.Named("color", strings.ToLower(strings.TrimSpace(update.Color))),
+    sql.Named("description", strings.TrimSpace(update.Description)),
+    sql.Named("location", strings.TrimSpace(update.Location)))
+}
+
+func (s *MotorcycleService) MarkSold(ctx context.Context, ownerID, id int) error {
+  markSoldQuery := `
+  UPDATE motorcycle
+     SET status = 'sold',
+         updated_at = current_timestamp
+   WHERE id = @id
+     AND owner_id = @owner_id
+     AND status = 'active'
+     AND deleted_at IS NULL;`
+
+  return s.mutate(ctx, ownerID, id, AuditActionUpdate, EventMotorcycleSold, markSoldQuery)
+}
+
+func (s *MotorcycleService) Delete(ctx context.Context, ownerID, id int) error {
+  deleteMotorcycleQuery := `
+  UPDATE motorcycle
+     SET deleted_at = current_timestamp
+   WHERE id = @id
+     AND owner_id = @owner_id
+     AND deleted_at IS NULL;`
+
+  return s.mutate(ctx, ownerID, id, AuditActionDelete, EventMotorcycleDeleted, deleteMotorcycleQuery)
+}
+
+func (s *MotorcycleService) Restore(ctx context.Context, ownerID, id int) error {
+  restoreMotorcycleQuery := `
+  UPDATE motorcycle
+     SET deleted_at = NULL
+   WHERE id = @id
+     AND owner_id = @owner_id
+     AND deleted_at >= @cutoff;`
+
+  return s.mutate(ctx, ownerID, id, AuditActionRestore, EventMotorcycleRestored, restoreMotorcycleQuery,
+    sql.Named("cutoff", time.Now().UTC().Add(-s.deletionGracePeriod).Format(time.DateTime)))
+}
+
+// Purge permanently deletes the listings whose grace period is over,
+// together with their images and favorites.
+func (s *MotorcycleService) Purge(ctx context.Context) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  purgeQueries := []string{`
+  DELETE
+    FROM favorite
+   WHERE motorcycle_id IN (SELECT id FROM motorcycle WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM contact_reveal
+   WHERE motorcycle_id IN (SELECT id FROM motorcycle WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM motorcycle_image
+   WHERE motorcycle_id IN (SELECT id FROM motorcycle WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM motorcycle
+   WHERE deleted_at < @cutoff;`,
+  }
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  cutoff := sql.Named("cutoff", time.Now().UTC().Add(-s.deletionGracePeriod).Format(time.DateTime))
+
+  for _, query := range purgeQueries {
+    _, err = tx.ExecContext(ctx, query, cutoff)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
 type MotorcycleHandler struct {
   s *MotorcycleService
 }
@@ -255,20 +1058,20 @@ func NewMotorcycleHandler(service *MotorcycleService) *MotorcycleHandler {
 }
 
 func (h *MotorcycleHandler) Create(w http.ResponseWriter, r *http.Request) {
-  ownerID := r.Context().Value("user_id").(int)
+  ownerID := principalFrom(r.Context()).UserID
   creation := MotorcycleCreation{}
 
   decoder := json.NewDecoder(r.Body)
   err := decoder.Decode(&creation)
   if nil != err {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, ErrMalformedBody)
     return
   }
 
   insertedID, err := h.s.Create(r.Context(), ownerID, &creation)
   if nil != err {
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
@@ -277,7 +1080,7 @@ func (h *MotorcycleHandler) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *MotorcycleHandler) Get(w http.ResponseWriter, r *http.Request) {
-  ownerID := r.Context().Value("user_id").(int)
+  ownerID := principalFrom(r.Context()).UserID
   pageStr := r.URL.Query().Get("page")
 
   page, err := strconv.Atoi(pageStr)
@@ -288,17 +1091,103 @@ func (h *MotorcycleHandler) Get(w http.ResponseWriter, r *http.Request) {
 
   motorcycles, err := h.s.GetFromUser(r.Context(), ownerID, page)
   if nil != err {
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
   response, err := json.Marshal(motorcycles)
   if nil != err {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
   w.WriteHeader(http.StatusOK)
   w.Write(response)
 }
+
+func (h *MotorcycleHandler) Delete(w http.ResponseWriter, r *http.Request) {
+  ownerID := principalFrom(r.Context()).UserID
+
+  motorcycleID, err := strconv.Atoi(r.PathValue("motorcycle_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  err = h.s.Delete(r.Context(), ownerID, motorcycleID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *MotorcycleHandler) Restore(w http.ResponseWriter, r *http.Request) {
+  ownerID := principalFrom(r.Context()).UserID
+
+  motorcycleID, err := strconv.Atoi(r.PathValue("motorcycle_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  err = h.s.Restore(r.Context(), ownerID, motorcycleID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *MotorcycleHandler) Update(w http.ResponseWriter, r *http.Request) {
+  ownerID := principalFrom(r.Context()).UserID
+
+  motorcycleID, err := strconv.Atoi(r.PathValue("motorcycle_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  update := MotorcycleUpdate{}
+
+  decoder := json.NewDecoder(r.Body)
+  err = decoder.Decode(&update)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  err = h.s.Update(r.Context(), ownerID, motorcycleID, &update)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *MotorcycleHandler) MarkSold(w http.ResponseWriter, r *http.Request) {
+  ownerID := principalFrom(r.Context()).UserID
+
+  motorcycleID, err := strconv.Atoi(r.PathValue("motorcycle_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  err = h.s.MarkSold(r.Context(), ownerID, motorcycleID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
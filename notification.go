@@ -0,0 +1,283 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+type NotificationType string
+
+const (
+  NotificationListingExpiring NotificationType = "listing_expiring"
+  NotificationListingExpired  NotificationType = "listing_expired"
+  NotificationFavoriteAdded   NotificationType = "favorite_added"
+  NotificationAccountLocked   NotificationType = "account_locked"
+  NotificationDataExportReady NotificationType = "data_export_ready"
+)
+
+type Notification struct {
+  ID        int              `json:"id"`
+  Type      NotificationType `json:"type"`
+  Data      map[string]any   `json:"data"`
+  ReadAt    *string          `json:"read_at"`
+  CreatedAt string           `json:"created_at"`
+}
+
+// NotificationRead marks either the notification ID or, when All is set,
+// every notification of the user as read.
+type NotificationRead struct {
+  ID  int  `json:"id"`
+  All bool `json:"all"`
+}
+
+var ErrNotificationNotFound = newError(ErrNotFound, "notification_not_found", "notification not found")
+
+type NotificationService struct {
+  db *sql.DB
+}
+
+func NewNotificationService(db *sql.DB) *NotificationService {
+  return &NotificationService{db}
+}
+
+// Notify adds a notification to the inbox of userID. Passing a transaction
+// as q makes the notification part of the change that caused it.
+func (s *NotificationService) Notify(ctx context.Context, q querier, userID int, notificationType NotificationType, data map[string]any) error {
+  createNotificationQuery := `
+  INSERT INTO notification (user_id, type, data)
+                    VALUES (@user_id, @type, @data);`
+
+  encoded, err := json.Marshal(data)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  _, err = q.ExecContext(ctx, createNotificationQuery,
+    sql.Named("user_id", userID),
+    sql.Named("type", notificationType),
+    sql.Named("data", string(encoded)))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+func (s *NotificationService) Get(ctx context.Context, userID int, unreadOnly bool, page int) (notifications []*Notification, err error) {
+  getNotificationsQuery := `
+  SELECT id,
+         type,
+         data,
+         read_at,
+         created_at
+    FROM notification
+   WHERE user_id = @user_id
+     AND (0 = @unread_only OR read_at IS NULL)
+ORDER BY id DESC
+   LIMIT 20
+   OFFSET 20 * (@page - 1);`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  if 0 >= page {
+    page = 1
+  }
+
+  result, err := s.db.QueryContext(ctx, getNotificationsQuery,
+    sql.Named("user_id", userID),
+    sql.Named("unread_only", unreadOnly),
+    sql.Named("page", page))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  notifications = make([]*Notification, 0)
+
+  for result.Next() {
+    var (
+      notification Notification
+      data         string
+    )
+
+    err = result.Scan(
+      &notification.ID,
+      &notification.Type,
+      &data,
+      &notification.ReadAt,
+      &notification.CreatedAt,
+    )
+
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    if err = json.Unmarshal([]byte(data), &notification.Data); nil != err {
+      slog.Error(fmt.Sprintf("notification %d: %v", notification.ID, err))
+      return nil, err
+    }
+
+    notifications = append(notifications, &notification)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return notifications, nil
+}
+
+func (s *NotificationService) CountUnread(ctx context.Context, userID int) (count int, err error) {
+  countUnreadQuery := `
+  SELECT count(*)
+    FROM notification
+   WHERE user_id = $1
+     AND read_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  err = s.db.QueryRowContext(ctx, countUnreadQuery, userID).Scan(&count)
+  if nil != err {
+    slog.Error(err.Error())
+    return 0, err
+  }
+
+  return count, nil
+}
+
+func (s *NotificationService) MarkRead(ctx context.Context, userID, id int) error {
+  markReadQuery := `
+  UPDATE notification
+     SET read_at = coalesce(read_at, current_timestamp)
+   WHERE id = @id
+     AND user_id = @user_id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  result, err := s.db.ExecContext(ctx, markReadQuery, sql.Named("id", id), sql.Named("user_id", userID))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return ErrNotificationNotFound
+  }
+
+  return nil
+}
+
+func (s *NotificationService) MarkAllRead(ctx context.Context, userID int) error {
+  markAllReadQuery := `
+  UPDATE notification
+     SET read_at = current_timestamp
+   WHERE user_id = $1
+     AND read_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  _, err := s.db.ExecContext(ctx, markAllReadQuery, userID)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+type NotificationHandler struct {
+  s *NotificationService
+}
+
+func NewNotificationHandler(service *NotificationService) *NotificationHandler {
+  return &NotificationHandler{service}
+}
+
+func (h *NotificationHandler) Get(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  query := r.URL.Query()
+
+  var (
+    page       = 1
+    unreadOnly bool
+    err        error
+  )
+
+  if value := query.Get("page"); "" != value {
+    if page, err = strconv.Atoi(value); nil != err {
+      slog.Error(err.Error())
+      writeError(w, r, ErrInvalidQuery)
+      return
+    }
+  }
+
+  if value := query.Get("unread"); "" != value {
+    if unreadOnly, err = strconv.ParseBool(value); nil != err {
+      slog.Error(err.Error())
+      writeError(w, r, ErrInvalidQuery)
+      return
+    }
+  }
+
+  notifications, err := h.s.Get(r.Context(), userID, unreadOnly, page)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(notifications)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *NotificationHandler) MarkRead(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  read := NotificationRead{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&read)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  switch {
+  case read.All:
+    err = h.s.MarkAllRead(r.Context(), userID)
+  case 0 < read.ID:
+    err = h.s.MarkRead(r.Context(), userID, read.ID)
+  default:
+    writeError(w, r, fmt.Errorf("%w: either all or id must be set", ErrInvalidInput))
+    return
+  }
+
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
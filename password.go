@@ -0,0 +1,388 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "golang.org/x/crypto/bcrypt"
+  "log/slog"
+  "math"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
+)
+
+type PasswordForgotten struct {
+  Email string `json:"email"`
+}
+
+type PasswordReset struct {
+  Token    string `json:"token"`
+  Password string `json:"password"`
+}
+
+type PasswordChange struct {
+  CurrentPassword string `json:"current_password"`
+  NewPassword     string `json:"new_password"`
+}
+
+var (
+  ErrInvalidResetToken = newError(ErrInvalidInput, "invalid_reset_token", "invalid password reset token")
+  ErrResetTokenExpired = newError(ErrGone, "reset_token_expired", "password reset token expired")
+)
+
+// PasswordPolicyError tells why a password was rejected.
+type PasswordPolicyError struct {
+  Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+  return "password " + e.Reason
+}
+
+// commonPasswords are rejected whatever the length requirement is.
+var commonPasswords = map[string]bool{
+  "password":    true,
+  "password1":   true,
+  "password123": true,
+  "12345678":    true,
+  "123456789":   true,
+  "1234567890":  true,
+  "qwertyuiop":  true,
+  "iloveyou":    true,
+  "motonica":    true,
+  "motorcycle":  true,
+}
+
+// PasswordPolicy decides which passwords are acceptable and how they are
+// hashed.
+type PasswordPolicy struct {
+  MinLength int
+  Cost      int
+}
+
+func passwordPolicyFromEnv() PasswordPolicy {
+  policy := PasswordPolicy{MinLength: 8, Cost: bcrypt.DefaultCost}
+
+  if value := os.Getenv("PASSWORD_MIN_LENGTH"); "" != value {
+    length, err := strconv.Atoi(value)
+    if nil != err || 1 > length {
+      slog.Error("invalid length in PASSWORD_MIN_LENGTH")
+    } else {
+      policy.MinLength = length
+    }
+  }
+
+  if value := os.Getenv("BCRYPT_COST"); "" != value {
+    cost, err := strconv.Atoi(value)
+    if nil != err || bcrypt.MinCost > cost || bcrypt.MaxCost < cost {
+      slog.Error("invalid cost in BCRYPT_COST")
+    } else {
+      policy.Cost = cost
+    }
+  }
+
+  return policy
+}
+
+// Validate checks password, chosen by the owner of email, against the
+// policy.
+func (p PasswordPolicy) Validate(password, email string) error {
+  switch {
+  case p.MinLength > utf8.RuneCountInString(password):
+    return &PasswordPolicyError{fmt.Sprintf("must have at least %d characters", p.MinLength)}
+  case 72 < len(password):
+    // bcrypt ignores anything past 72 bytes.
+    return &PasswordPolicyError{"must have at most 72 bytes"}
+  case commonPasswords[strings.ToLower(password)]:
+    return &PasswordPolicyError{"is too common"}
+  case "" != email && strings.EqualFold(password, strings.TrimSpace(email)):
+    return &PasswordPolicyError{"must not be the email address"}
+  }
+
+  return nil
+}
+
+func (p PasswordPolicy) Hash(password string) (string, error) {
+  hashed, err := bcrypt.GenerateFromPassword([]byte(password), p.Cost)
+  if nil != err {
+    slog.Error(err.Error())
+    return "", err
+  }
+
+  return string(hashed), nil
+}
+
+// Outdated tells whether hash was made with a lower cost than the policy's,
+// meaning it should be replaced when the password is next known.
+func (p PasswordPolicy) Outdated(hash string) bool {
+  cost, err := bcrypt.Cost([]byte(hash))
+  return nil == err && p.Cost > cost
+}
+
+type PasswordResetService struct {
+  db        *sql.DB
+  audit     *AuditService
+  emails    *EmailService
+  sessions  *SessionService
+  passwords PasswordPolicy
+  ttl       time.Duration
+  url       string
+}
+
+func NewPasswordResetService(db *sql.DB, audit *AuditService, emails *EmailService, sessions *SessionService, passwords PasswordPolicy, ttl time.Duration, resetURL string) *PasswordResetService {
+  return &PasswordResetService{db, audit, emails, sessions, passwords, ttl, resetURL}
+}
+
+// passwordResetURLFromEnv is the link reset tokens are appended to.
+func passwordResetURLFromEnv() string {
+  if value := os.Getenv("PASSWORD_RESET_URL"); "" != value {
+    return value
+  }
+
+  return "motonica://reset-password"
+}
+
+// Forgot emails a reset link to the account registered with email, if any.
+// Unknown addresses are not an error so that callers cannot tell which
+// addresses have an account.
+func (s *PasswordResetService) Forgot(ctx context.Context, email string) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  getUserQuery := `
+  SELECT id, email, first_name, locale
+    FROM "user"
+   WHERE email = $1
+     AND deleted_at IS NULL;`
+
+  // Only the most recent link works.
+  useResetsQuery := `
+  UPDATE password_reset
+     SET used_at = current_timestamp
+   WHERE user_id = $1
+     AND used_at IS NULL;`
+
+  createResetQuery := `
+  INSERT INTO password_reset (user_id, token_hash, expires_at)
+                      VALUES (@user_id, @token_hash, @expires_at);`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    userID                     int
+    address, firstName, locale string
+  )
+
+  err = tx.QueryRowContext(ctx, getUserQuery, strings.TrimSpace(email)).Scan(&userID, &address, &firstName, &locale)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  _, err = tx.ExecContext(ctx, useResetsQuery, userID)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  token := randomHex(32)
+
+  _, err = tx.ExecContext(ctx, createResetQuery,
+    sql.Named("user_id", userID),
+    sql.Named("token_hash", hashToken(token)),
+    sql.Named("expires_at", time.Now().UTC().Add(s.ttl).Format(time.DateTime)))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  err = s.emails.Enqueue(ctx, tx, address, "password_reset", locale, map[string]any{
+    "first_name": firstName,
+    "url":        s.url + "?token=" + url.QueryEscape(token),
+    "expires_in": int(math.Round(s.ttl.Minutes())),
+  })
+  if nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Reset consumes a reset token, sets the new password and signs the user
+// out everywhere.
+func (s *PasswordResetService) Reset(ctx context.Context, reset *PasswordReset) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  getResetQuery := `
+  SELECT r.user_id, r.expires_at, u.email
+    FROM password_reset r
+    JOIN "user" u
+      ON u.id = r.user_id
+   WHERE r.token_hash = $1
+     AND r.used_at IS NULL;`
+
+  resetPasswordQuery := `
+  UPDATE "user"
+     SET password = @password,
+         updated_at = current_timestamp
+   WHERE id = @id
+     AND deleted_at IS NULL;`
+
+  useResetsQuery := `
+  UPDATE password_reset
+     SET used_at = current_timestamp
+   WHERE user_id = $1
+     AND used_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    userID           int
+    expiresAt, email string
+  )
+
+  err = tx.QueryRowContext(ctx, getResetQuery, hashToken(reset.Token)).Scan(&userID, &expiresAt, &email)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrInvalidResetToken
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  if expiresAt < time.Now().UTC().Format(time.DateTime) {
+    return ErrResetTokenExpired
+  }
+
+  if err = s.passwords.Validate(reset.Password, email); nil != err {
+    return err
+  }
+
+  hashedPassword, err := s.passwords.Hash(reset.Password)
+  if nil != err {
+    return err
+  }
+
+  before, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrInvalidResetToken
+    }
+
+    return err
+  }
+
+  result, err := tx.ExecContext(ctx, resetPasswordQuery, sql.Named("id", userID), sql.Named("password", hashedPassword))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return ErrInvalidResetToken
+  }
+
+  after, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionUpdate, "user", userID, before, after)
+  if nil != err {
+    return err
+  }
+
+  if err = s.sessions.RevokeAll(ctx, tx, userID, 0); nil != err {
+    return err
+  }
+
+  _, err = tx.ExecContext(ctx, useResetsQuery, userID)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+type PasswordResetHandler struct {
+  s *PasswordResetService
+}
+
+func NewPasswordResetHandler(service *PasswordResetService) *PasswordResetHandler {
+  return &PasswordResetHandler{service}
+}
+
+func (h *PasswordResetHandler) Forgot(w http.ResponseWriter, r *http.Request) {
+  forgotten := PasswordForgotten{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&forgotten)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  if err = h.s.Forgot(r.Context(), forgotten.Email); nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *PasswordResetHandler) Reset(w http.ResponseWriter, r *http.Request) {
+  reset := PasswordReset{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&reset)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  err = h.s.Reset(r.Context(), &reset)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/mattn/go-sqlite3"
+  "log/slog"
+  "math"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// The kinds of domain errors, which decide the status they are answered
+// with. Services return a *DomainError of one of these kinds, or the kind
+// itself when there is nothing more specific to say.
+var (
+  ErrInvalidInput    = errors.New("invalid input")
+  ErrUnauthenticated = errors.New("unauthenticated")
+  ErrForbidden       = errors.New("forbidden")
+  ErrNotFound        = errors.New("not found")
+  ErrConflict        = errors.New("conflict")
+  ErrGone            = errors.New("gone")
+)
+
+var errorKindStatus = map[error]int{
+  ErrInvalidInput:    http.StatusBadRequest,
+  ErrUnauthenticated: http.StatusUnauthorized,
+  ErrForbidden:       http.StatusForbidden,
+  ErrNotFound:        http.StatusNotFound,
+  ErrConflict:        http.StatusConflict,
+  ErrGone:            http.StatusGone,
+}
+
+// DomainError is an error clients can act on: Code is stable and meant to
+// be branched on, Message is for humans.
+type DomainError struct {
+  Kind    error
+  Code    string
+  Message string
+}
+
+func newError(kind error, code, message string) *DomainError {
+  return &DomainError{kind, code, message}
+}
+
+func (e *DomainError) Error() string {
+  return e.Message
+}
+
+func (e *DomainError) Unwrap() error {
+  return e.Kind
+}
+
+var (
+  ErrMalformedBody = newError(ErrInvalidInput, "malformed_body", "request body is not valid JSON")
+  ErrInvalidID     = newError(ErrInvalidInput, "invalid_id", "id in the path is not a number")
+  ErrInvalidQuery  = newError(ErrInvalidInput, "invalid_query", "query parameters are not valid")
+)
+
+// uniqueViolation tells whether err is SQLite refusing a duplicate and, if
+// so, for which column, as "table.column".
+func uniqueViolation(err error) (column string, ok bool) {
+  var sqliteErr sqlite3.Error
+  if !errors.As(err, &sqliteErr) || sqlite3.ErrConstraintUnique != sqliteErr.ExtendedCode {
+    return "", false
+  }
+
+  _, column, _ = strings.Cut(sqliteErr.Error(), "UNIQUE constraint failed: ")
+  return column, true
+}
+
+// retryable errors are answered 429, telling when to try again.
+type retryable interface {
+  error
+  code() string
+  retryAfter() time.Duration
+}
+
+// Problem is an RFC 7807 problem details object, extended with a stable
+// code, the rejected fields and the id of the request for support.
+type Problem struct {
+  Type      string       `json:"type"`
+  Title     string       `json:"title"`
+  Status    int          `json:"status"`
+  Detail    string       `json:"detail,omitempty"`
+  Instance  string       `json:"instance,omitempty"`
+  Code      string       `json:"code"`
+  Errors    []FieldError `json:"errors,omitempty"`
+  RequestID string       `json:"request_id,omitempty"`
+}
+
+// writeProblem answers with a problem of status. It is what writeError
+// comes down to, for the few answers that depend on the route rather than
+// on the error.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+  writeProblemDetails(w, r, &Problem{Status: status, Code: code, Detail: detail})
+}
+
+func writeProblemDetails(w http.ResponseWriter, r *http.Request, problem *Problem) {
+  problem.Type = "about:blank"
+  problem.Title = http.StatusText(problem.Status)
+  problem.Instance = r.URL.Path
+
+  if metadata, ok := requestMetadataFrom(r.Context()); ok {
+    problem.RequestID = metadata.ID
+  }
+
+  response, err := json.Marshal(problem)
+  if nil != err {
+    slog.Error(err.Error())
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/problem+json")
+  w.WriteHeader(problem.Status)
+  w.Write(response)
+}
+
+// writeError answers with the problem err stands for. Errors that are not
+// domain errors are answered 500 without detail, as they may leak
+// internals; they are logged where they happen.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+  var (
+    validationErr     *ValidationError
+    policyErr         *PasswordPolicyError
+    authenticationErr *AuthenticationError
+    domainErr         *DomainError
+    retryableErr      retryable
+  )
+
+  switch {
+  case errors.As(err, &validationErr):
+    writeProblemDetails(w, r, &Problem{
+      Status: http.StatusUnprocessableEntity,
+      Code:   "validation_failed",
+      Detail: "some fields are invalid",
+      Errors: validationErr.Errors,
+    })
+  case errors.As(err, &policyErr):
+    writeProblem(w, r, http.StatusBadRequest, FieldWeakPassword, policyErr.Error())
+  case errors.As(err, &authenticationErr):
+    w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=%q, error_description=%q", authRealm, authenticationErr.Code, authenticationErr.Description))
+    writeProblem(w, r, http.StatusUnauthorized, authenticationErr.Code, authenticationErr.Description)
+  case errors.As(err, &retryableErr):
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryableErr.retryAfter().Seconds()))))
+    writeProblem(w, r, http.StatusTooManyRequests, retryableErr.code(), retryableErr.Error())
+  case errors.As(err, &domainErr):
+    status, ok := errorKindStatus[domainErr.Kind]
+    if !ok {
+      status = http.StatusInternalServerError
+    }
+
+    if http.StatusUnauthorized == status {
+      w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
+    }
+
+    writeProblem(w, r, status, domainErr.Code, domainErr.Message)
+  default:
+    for kind, status := range errorKindStatus {
+      if errors.Is(err, kind) {
+        writeProblem(w, r, status, strings.ReplaceAll(kind.Error(), " ", "_"), err.Error())
+        return
+      }
+    }
+
+    writeProblem(w, r, http.StatusInternalServerError, "internal_error", "")
+  }
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+  "log/slog"
+  "strings"
+  "time"
+  "unicode/utf8"
+)
+
+// PublicUser is what other users see of an account: enough to recognise a
+// seller by, without the contact details scrapers are after. Rating stays
+// null until sellers can be reviewed.
+type PublicUser struct {
+  ID           int      `json:"id"`
+  DisplayName  string   `json:"display_name"`
+  PictureURL   *string  `json:"picture_url"`
+  MemberSince  string   `json:"member_since"`
+  ListingCount int      `json:"listing_count"`
+  Rating       *float64 `json:"rating"`
+}
+
+// ListingContact is how to reach the seller of a listing. On listings, each
+// field is only set when the seller chose to show it there; on request, it
+// is set unless the seller opted out of revealing it.
+type ListingContact struct {
+  PhoneNumber string `json:"phone_number,omitempty"`
+  Email       string `json:"email,omitempty"`
+}
+
+// displayName is the first name and the initial of the last name, so that
+// full names are not given away.
+func displayName(firstName string, lastName *string) string {
+  if nil == lastName || "" == strings.TrimSpace(*lastName) {
+    return firstName
+  }
+
+  initial, _ := utf8.DecodeRuneInString(strings.TrimSpace(*lastName))
+  return firstName + " " + string(initial) + "."
+}
+
+func (s *UserService) GetProfile(ctx context.Context, id int) (*PublicUser, error) {
+  getProfileQuery := `
+  SELECT u.id,
+         u.first_name,
+         u.last_name,
+         u.picture_url,
+         date(u.created_at),
+         (SELECT count(*)
+            FROM motorcycle m
+           WHERE m.owner_id = u.id
+             AND m.status = 'active'
+             AND m.deleted_at IS NULL)
+    FROM "user" u
+   WHERE u.id = $1
+     AND u.deleted_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  var (
+    profile   PublicUser
+    firstName string
+    lastName  *string
+  )
+
+  err := s.db.QueryRowContext(ctx, getProfileQuery, id).Scan(
+    &profile.ID,
+    &firstName,
+    &lastName,
+    &profile.PictureURL,
+    &profile.MemberSince,
+    &profile.ListingCount,
+  )
+
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrUserNotFound
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  profile.DisplayName = displayName(firstName, lastName)
+
+  return &profile, nil
+}
+
+func (s *UserService) GetProfiles(ctx context.Context, page int) (profiles []*PublicUser, err error) {
+  getProfilesQuery := `
+  SELECT u.id,
+         u.first_name,
+         u.last_name,
+         u.picture_url,
+         date(u.created_at),
+         (SELECT count(*)
+            FROM motorcycle m
+           WHERE m.owner_id = u.id
+             AND m.status = 'active'
+             AND m.deleted_at IS NULL)
+    FROM "user" u
+   WHERE u.deleted_at IS NULL
+ORDER BY u.created_at
+   LIMIT 10
+   OFFSET 10 * (@page - 1);`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  result, err := s.db.QueryContext(ctx, getProfilesQuery, sql.Named("page", page))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  profiles = make([]*PublicUser, 0)
+
+  for result.Next() {
+    var (
+      profile   PublicUser
+      firstName string
+      lastName  *string
+    )
+
+    err = result.Scan(
+      &profile.ID,
+      &firstName,
+      &lastName,
+      &profile.PictureURL,
+      &profile.MemberSince,
+      &profile.ListingCount,
+    )
+
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    profile.DisplayName = displayName(firstName, lastName)
+    profiles = append(profiles, &profile)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return profiles, nil
+}
+
+// ListingContact returns the contact details id shows on their listings,
+// or nil when they show none.
+func (s *UserService) ListingContact(ctx context.Context, id int) (*ListingContact, error) {
+  getContactQuery := `
+  SELECT phone_number,
+         email,
+         show_phone_on_listings,
+         show_email_on_listings
+    FROM "user"
+   WHERE id = $1
+     AND deleted_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  var (
+    contact              ListingContact
+    showPhone, showEmail bool
+  )
+
+  err := s.db.QueryRowContext(ctx, getContactQuery, id).Scan(&contact.PhoneNumber, &contact.Email, &showPhone, &showEmail)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrUserNotFound
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if !showPhone {
+    contact.PhoneNumber = ""
+  }
+
+  if !showEmail {
+    contact.Email = ""
+  }
+
+  if "" == contact.PhoneNumber && "" == contact.Email {
+    return nil, nil
+  }
+
+  return &contact, nil
+}
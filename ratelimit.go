@@ -0,0 +1,185 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "math"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// RateLimit allows Requests per Period, which may all come at once: it is
+// a token bucket holding Requests tokens and refilled at Requests/Period.
+type RateLimit struct {
+  Requests int
+  Period   time.Duration
+}
+
+// parseRateLimit reads a limit written as "<requests>/<period>", such as
+// "20/1m".
+func parseRateLimit(value string) (RateLimit, error) {
+  requests, period, found := strings.Cut(value, "/")
+  if !found {
+    return RateLimit{}, fmt.Errorf("rate limit %q is not <requests>/<period>", value)
+  }
+
+  n, err := strconv.Atoi(strings.TrimSpace(requests))
+  if nil != err || 1 > n {
+    return RateLimit{}, fmt.Errorf("rate limit %q has an invalid number of requests", value)
+  }
+
+  d, err := time.ParseDuration(strings.TrimSpace(period))
+  if nil != err || 0 >= d {
+    return RateLimit{}, fmt.Errorf("rate limit %q has an invalid period", value)
+  }
+
+  return RateLimit{n, d}, nil
+}
+
+func (l RateLimit) rate() float64 {
+  return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitResult is the state of a bucket after taking from it.
+type RateLimitResult struct {
+  Allowed    bool
+  Remaining  int
+  Reset      time.Duration // until the bucket is full again
+  RetryAfter time.Duration // until the next request is allowed, when not
+}
+
+// RateLimitStore keeps the buckets. The in-memory store is enough for a
+// single instance; several instances need a shared one.
+type RateLimitStore interface {
+  Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+type bucket struct {
+  tokens    float64
+  updatedAt time.Time
+  limit     RateLimit
+}
+
+// refill adds the tokens earned since the bucket was last updated.
+func (b *bucket) refill(now time.Time) {
+  b.tokens = min(float64(b.limit.Requests), b.tokens+now.Sub(b.updatedAt).Seconds()*b.limit.rate())
+  b.updatedAt = now
+}
+
+type MemoryRateLimitStore struct {
+  mu      sync.Mutex
+  buckets map[string]*bucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+  return &MemoryRateLimitStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  now := time.Now()
+
+  b, ok := s.buckets[key]
+  if !ok || b.limit != limit {
+    b = &bucket{tokens: float64(limit.Requests), updatedAt: now, limit: limit}
+    s.buckets[key] = b
+  }
+
+  b.refill(now)
+
+  result := RateLimitResult{}
+
+  if 1 <= b.tokens {
+    b.tokens--
+    result.Allowed = true
+  } else {
+    result.RetryAfter = time.Duration((1 - b.tokens) / limit.rate() * float64(time.Second))
+  }
+
+  result.Remaining = int(b.tokens)
+  result.Reset = time.Duration((float64(limit.Requests) - b.tokens) / limit.rate() * float64(time.Second))
+
+  return result, nil
+}
+
+// Purge drops the buckets that have filled up again, as they are no
+// different from new ones.
+func (s *MemoryRateLimitStore) Purge(ctx context.Context) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  now := time.Now()
+
+  for key, b := range s.buckets {
+    if b.refill(now); float64(b.limit.Requests) <= b.tokens {
+      delete(s.buckets, key)
+    }
+  }
+
+  return nil
+}
+
+type RateLimiter struct {
+  store RateLimitStore
+}
+
+func NewRateLimiter(store RateLimitStore) *RateLimiter {
+  return &RateLimiter{store}
+}
+
+// Limit wraps next so that every client may call it at most limit. Clients
+// are told apart by their user id when authenticated, so it must go inside
+// the authorization middleware, and by their address otherwise. The limit
+// can be overridden with RATE_LIMIT_<NAME>, such as RATE_LIMIT_SIGNUP=5/1h.
+func (l *RateLimiter) Limit(name string, limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+  key := "RATE_LIMIT_" + strings.ToUpper(name)
+  if value := os.Getenv(key); "" != value {
+    override, err := parseRateLimit(value)
+    if nil != err {
+      slog.Error("invalid rate limit in " + key + ": " + err.Error())
+    } else {
+      limit = override
+    }
+  }
+
+  policy := fmt.Sprintf("%d;w=%d", limit.Requests, int(math.Ceil(limit.Period.Seconds())))
+
+  return func(w http.ResponseWriter, r *http.Request) {
+    client := "ip:"
+    if metadata, ok := requestMetadataFrom(r.Context()); ok {
+      client += metadata.IP
+    }
+
+    if principal := principalFrom(r.Context()); nil != principal {
+      client = "user:" + strconv.Itoa(principal.UserID)
+    }
+
+    result, err := l.store.Take(r.Context(), name+":"+client, limit)
+    if nil != err {
+      // A broken store must not take the API down with it.
+      slog.Error(err.Error())
+      next.ServeHTTP(w, r)
+      return
+    }
+
+    w.Header().Set("RateLimit-Policy", policy)
+    w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+    w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+    w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+
+    if !result.Allowed {
+      w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+      writeProblem(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests, retry later")
+      return
+    }
+
+    next.ServeHTTP(w, r)
+  }
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "github.com/golang-jwt/jwt/v5"
+  "log/slog"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// TokenPair is what signing in and refreshing hand out: a short-lived
+// access token for the Authorization header and a single-use refresh token
+// to get the next pair.
+type TokenPair struct {
+  AccessToken  string `json:"access_token"`
+  RefreshToken string `json:"refresh_token"`
+  TokenType    string `json:"token_type"`
+  ExpiresIn    int    `json:"expires_in"`
+}
+
+// Session is a signed in device as listed to its user.
+type Session struct {
+  ID         int     `json:"id"`
+  DeviceName *string `json:"device_name"`
+  UserAgent  *string `json:"user_agent"`
+  IP         *string `json:"ip"`
+  Current    bool    `json:"current"`
+  CreatedAt  string  `json:"created_at"`
+  LastSeenAt string  `json:"last_seen_at"`
+  ExpiresAt  string  `json:"expires_at"`
+}
+
+type TokenRefresh struct {
+  RefreshToken string `json:"refresh_token"`
+}
+
+var (
+  ErrInvalidRefreshToken = newError(ErrUnauthenticated, "invalid_refresh_token", "invalid refresh token")
+  ErrRefreshTokenReused  = newError(ErrUnauthenticated, "refresh_token_reused", "refresh token reused")
+  ErrSessionRevoked      = newError(ErrUnauthenticated, "session_revoked", "session revoked")
+  ErrSessionNotFound     = newError(ErrNotFound, "session_not_found", "session not found")
+)
+
+const (
+  // sessionTouchInterval is how stale last_seen_at may get before a request
+  // updates it, sparing a write on every request.
+  sessionTouchInterval = time.Minute
+
+  deviceNameMaxLength = 64
+  userAgentMaxLength  = 256
+)
+
+// truncate cuts s to at most n bytes, for client supplied values stored as
+// they come.
+func truncate(s string, n int) string {
+  if len(s) > n {
+    return s[:n]
+  }
+
+  return s
+}
+
+// SessionService keeps a session per sign in. Every refresh token belongs to
+// one and can be used once; presenting a used one again means it leaked, so
+// the whole session is revoked.
+type SessionService struct {
+  db         *sql.DB
+  keys       *KeyManager
+  accessTTL  time.Duration
+  refreshTTL time.Duration
+}
+
+func NewSessionService(db *sql.DB, keys *KeyManager, accessTTL, refreshTTL time.Duration) *SessionService {
+  return &SessionService{db, keys, accessTTL, refreshTTL}
+}
+
+// Create starts a session for userID on the device making the request and
+// returns its first token pair.
+func (s *SessionService) Create(ctx context.Context, userID int, deviceName string) (pair *TokenPair, err error) {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  createSessionQuery := `
+  INSERT INTO session (user_id, device_name, user_agent, ip, expires_at)
+               VALUES (@user_id, @device_name, @user_agent, @ip, @expires_at)
+    RETURNING id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    sessionID             int
+    device, userAgent, ip any
+  )
+
+  if metadata, ok := requestMetadataFrom(ctx); ok {
+    ip = metadata.IP
+    if "" != metadata.UserAgent {
+      userAgent = truncate(metadata.UserAgent, userAgentMaxLength)
+    }
+  }
+
+  if deviceName = strings.TrimSpace(deviceName); "" != deviceName {
+    device = truncate(deviceName, deviceNameMaxLength)
+  }
+
+  err = tx.QueryRowContext(ctx, createSessionQuery,
+    sql.Named("user_id", userID),
+    sql.Named("device_name", device),
+    sql.Named("user_agent", userAgent),
+    sql.Named("ip", ip),
+    sql.Named("expires_at", time.Now().UTC().Add(s.refreshTTL).Format(time.DateTime))).
+    Scan(&sessionID)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  pair, err = s.issue(ctx, tx, userID, sessionID)
+  if nil != err {
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return pair, nil
+}
+
+// issue stores a new refresh token for sessionID and signs an access token
+// bound to it.
+func (s *SessionService) issue(ctx context.Context, tx *sql.Tx, userID, sessionID int) (*TokenPair, error) {
+  createRefreshTokenQuery := `
+  INSERT INTO refresh_token (session_id, token_hash)
+                     VALUES (@session_id, @token_hash);`
+
+  refreshToken := randomHex(32)
+
+  _, err := tx.ExecContext(ctx, createRefreshTokenQuery,
+    sql.Named("session_id", sessionID),
+    sql.Named("token_hash", hashToken(refreshToken)))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  now := time.Now()
+
+  claims := jwt.MapClaims{
+    "sub":     "authentication",
+    "iat":     jwt.NewNumericDate(now),
+    "exp":     jwt.NewNumericDate(now.Add(s.accessTTL)),
+    "user_id": userID,
+    "sid":     sessionID,
+  }
+
+  accessToken, err := s.keys.Sign(claims)
+  if nil != err {
+    return nil, err
+  }
+
+  return &TokenPair{
+    AccessToken:  accessToken,
+    RefreshToken: refreshToken,
+    TokenType:    "Bearer",
+    ExpiresIn:    int(s.accessTTL.Seconds()),
+  }, nil
+}
+
+// Refresh exchanges a refresh token for a new pair, extending the session.
+func (s *SessionService) Refresh(ctx context.Context, refreshToken string) (pair *TokenPair, err error) {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  getRefreshTokenQuery := `
+  SELECT t.id,
+         t.used_at IS NOT NULL,
+         s.id,
+         s.user_id,
+         s.revoked_at IS NULL AND s.expires_at > @now AND u.deleted_at IS NULL
+    FROM refresh_token t
+    JOIN session s
+      ON s.id = t.session_id
+    JOIN "user" u
+      ON u.id = s.user_id
+   WHERE t.token_hash = @token_hash;`
+
+  useRefreshTokenQuery := `
+  UPDATE refresh_token
+     SET used_at = current_timestamp
+   WHERE id = $1
+     AND used_at IS NULL;`
+
+  extendSessionQuery := `
+  UPDATE session
+     SET expires_at = @expires_at,
+         last_seen_at = current_timestamp,
+         ip = coalesce(@ip, ip)
+   WHERE id = @id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    tokenID, sessionID, userID int
+    used, active               bool
+  )
+
+  now := time.Now().UTC()
+
+  err = tx.QueryRowContext(ctx, getRefreshTokenQuery,
+    sql.Named("now", now.Format(time.DateTime)),
+    sql.Named("token_hash", hashToken(refreshToken))).
+    Scan(&tokenID, &used, &sessionID, &userID, &active)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrInvalidRefreshToken
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if !active {
+    return nil, ErrInvalidRefreshToken
+  }
+
+  if used {
+    slog.Warn("refresh token reused, revoking its session", "session_id", sessionID, "user_id", userID)
+
+    if _, err = s.revoke(ctx, tx, `id = $1`, sessionID); nil != err {
+      return nil, err
+    }
+
+    if err = tx.Commit(); nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    return nil, ErrRefreshTokenReused
+  }
+
+  result, err := tx.ExecContext(ctx, useRefreshTokenQuery, tokenID)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return nil, ErrInvalidRefreshToken
+  }
+
+  var ip any
+  if metadata, ok := requestMetadataFrom(ctx); ok {
+    ip = metadata.IP
+  }
+
+  _, err = tx.ExecContext(ctx, extendSessionQuery,
+    sql.Named("id", sessionID),
+    sql.Named("expires_at", now.Add(s.refreshTTL).Format(time.DateTime)),
+    sql.Named("ip", ip))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  pair, err = s.issue(ctx, tx, userID, sessionID)
+  if nil != err {
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return pair, nil
+}
+
+// revoke revokes the sessions matching condition and tells how many were.
+func (s *SessionService) revoke(ctx context.Context, q querier, condition string, args ...any) (revoked int64, err error) {
+  result, err := q.ExecContext(ctx, `
+  UPDATE session
+     SET revoked_at = current_timestamp
+   WHERE revoked_at IS NULL
+     AND `+condition+`;`, args...)
+  if nil != err {
+    slog.Error(err.Error())
+    return 0, err
+  }
+
+  revoked, _ = result.RowsAffected()
+
+  return revoked, nil
+}
+
+// Revoke ends the session sessionID of userID, as when signing out or
+// signing a lost device out.
+func (s *SessionService) Revoke(ctx context.Context, userID, sessionID int) error {
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  revoked, err := s.revoke(ctx, s.db, `id = @id AND user_id = @user_id`, sql.Named("id", sessionID), sql.Named("user_id", userID))
+  if nil != err {
+    return err
+  }
+
+  if 0 == revoked {
+    return ErrSessionNotFound
+  }
+
+  return nil
+}
+
+// RevokeAll ends every session of userID but exceptSessionID, which may be
+// zero to end them all.
+func (s *SessionService) RevokeAll(ctx context.Context, q querier, userID, exceptSessionID int) error {
+  _, err := s.revoke(ctx, q, `user_id = @user_id AND id <> @except_id`, sql.Named("user_id", userID), sql.Named("except_id", exceptSessionID))
+  return err
+}
+
+// Validate tells whether sessionID of userID can still be used and, if so,
+// returns the principal it authenticates.
+func (s *SessionService) Validate(ctx context.Context, userID, sessionID int) (*Principal, error) {
+  getSessionQuery := `
+  SELECT s.revoked_at IS NULL AND s.expires_at > @now AND u.deleted_at IS NULL,
+         u.role
+    FROM session s
+    JOIN "user" u
+      ON u.id = s.user_id
+   WHERE s.id = @id
+     AND s.user_id = @user_id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  var (
+    active bool
+    role   string
+  )
+
+  err := s.db.QueryRowContext(ctx, getSessionQuery,
+    sql.Named("now", time.Now().UTC().Format(time.DateTime)),
+    sql.Named("id", sessionID),
+    sql.Named("user_id", userID)).
+    Scan(&active, &role)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrSessionRevoked
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if !active {
+    return nil, ErrSessionRevoked
+  }
+
+  s.touch(ctx, sessionID)
+
+  return &Principal{
+    UserID:    userID,
+    Roles:     []string{role},
+    SessionID: sessionID,
+    Method:    AuthMethodSession,
+  }, nil
+}
+
+// touch records that sessionID was just seen, and from where. Failing to do
+// so must not fail the request, so errors are only logged.
+func (s *SessionService) touch(ctx context.Context, sessionID int) {
+  touchSessionQuery := `
+  UPDATE session
+     SET last_seen_at = current_timestamp,
+         ip = coalesce(@ip, ip)
+   WHERE id = @id
+     AND last_seen_at < @stale;`
+
+  var ip any
+  if metadata, ok := requestMetadataFrom(ctx); ok {
+    ip = metadata.IP
+  }
+
+  _, err := s.db.ExecContext(ctx, touchSessionQuery,
+    sql.Named("id", sessionID),
+    sql.Named("ip", ip),
+    sql.Named("stale", time.Now().UTC().Add(-sessionTouchInterval).Format(time.DateTime)))
+  if nil != err {
+    slog.Error(err.Error())
+  }
+}
+
+// Get lists the active sessions of userID, most recently seen first,
+// flagging currentSessionID.
+func (s *SessionService) Get(ctx context.Context, userID, currentSessionID int) (sessions []*Session, err error) {
+  getSessionsQuery := `
+  SELECT id,
+         device_name,
+         user_agent,
+         ip,
+         created_at,
+         last_seen_at,
+         expires_at
+    FROM session
+   WHERE user_id = @user_id
+     AND revoked_at IS NULL
+     AND expires_at > @now
+ORDER BY last_seen_at DESC, id DESC;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  result, err := s.db.QueryContext(ctx, getSessionsQuery,
+    sql.Named("user_id", userID),
+    sql.Named("now", time.Now().UTC().Format(time.DateTime)))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  sessions = make([]*Session, 0)
+
+  for result.Next() {
+    var session Session
+
+    err = result.Scan(
+      &session.ID,
+      &session.DeviceName,
+      &session.UserAgent,
+      &session.IP,
+      &session.CreatedAt,
+      &session.LastSeenAt,
+      &session.ExpiresAt,
+    )
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    session.Current = currentSessionID == session.ID
+    sessions = append(sessions, &session)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return sessions, nil
+}
+
+// Purge deletes the sessions that ended more than a day ago, together with
+// their refresh tokens.
+func (s *SessionService) Purge(ctx context.Context) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  purgeQueries := []string{`
+  DELETE
+    FROM refresh_token
+   WHERE session_id IN (SELECT id
+                          FROM session
+                         WHERE revoked_at < @cutoff
+                            OR expires_at < @cutoff);`, `
+  DELETE
+    FROM session
+   WHERE revoked_at < @cutoff
+      OR expires_at < @cutoff;`,
+  }
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  cutoff := sql.Named("cutoff", time.Now().UTC().Add(-24*time.Hour).Format(time.DateTime))
+
+  for _, query := range purgeQueries {
+    _, err = tx.ExecContext(ctx, query, cutoff)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+type SessionHandler struct {
+  s *SessionService
+}
+
+func NewSessionHandler(service *SessionService) *SessionHandler {
+  return &SessionHandler{service}
+}
+
+func (h *SessionHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+  refresh := TokenRefresh{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&refresh)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  pair, err := h.s.Refresh(r.Context(), refresh.RefreshToken)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(pair)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *SessionHandler) Logout(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  sessionID := principalFrom(r.Context()).SessionID
+
+  if err := h.s.Revoke(r.Context(), userID, sessionID); nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *SessionHandler) Get(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  sessionID := principalFrom(r.Context()).SessionID
+
+  sessions, err := h.s.Get(r.Context(), userID, sessionID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(sessions)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *SessionHandler) Delete(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  sessionID, err := strconv.Atoi(r.PathValue("session_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  err = h.s.Revoke(r.Context(), userID, sessionID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteOthers signs out every session of the user but the current one.
+func (h *SessionHandler) DeleteOthers(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  sessionID := principalFrom(r.Context()).SessionID
+
+  if err := h.s.RevokeAll(r.Context(), h.s.db, userID, sessionID); nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "log/slog"
+  "math"
+  "net/http"
+  "sync"
+  "time"
+)
+
+// statsWeeks is how many weeks, counting the current one, are reported in
+// the new listings series.
+const statsWeeks = 8
+
+var ErrInvalidGrouping = newError(ErrInvalidInput, "invalid_grouping", "invalid statistics grouping")
+
+// statsGroupings maps the accepted group_by values to their column, so
+// that the grouping column is never taken verbatim from the request.
+var statsGroupings = map[string]string{
+  "brand":    "brand",
+  "type":     "type",
+  "year":     "year",
+  "location": "location",
+}
+
+type WeeklyCount struct {
+  Week  string `json:"week"`
+  Count int    `json:"count"`
+}
+
+type MotorcycleStatistics struct {
+  Group              string         `json:"group"`
+  Count              int            `json:"count"`
+  MinPrice           float64        `json:"min_price"`
+  MedianPrice        float64        `json:"median_price"`
+  MaxPrice           float64        `json:"max_price"`
+  AverageMileage     float64        `json:"average_mileage"`
+  NewListingsPerWeek []*WeeklyCount `json:"new_listings_per_week"`
+}
+
+type MotorcycleStatisticsReport struct {
+  GroupBy     string                  `json:"group_by"`
+  GeneratedAt time.Time               `json:"generated_at"`
+  Groups      []*MotorcycleStatistics `json:"groups"`
+}
+
+type statsCacheEntry struct {
+  report    *MotorcycleStatisticsReport
+  expiresAt time.Time
+}
+
+type StatsService struct {
+  db    *sql.DB
+  ttl   time.Duration
+  mu    sync.Mutex
+  cache map[string]*statsCacheEntry
+}
+
+func NewStatsService(db *sql.DB, ttl time.Duration) *StatsService {
+  return &StatsService{db: db, ttl: ttl, cache: map[string]*statsCacheEntry{}}
+}
+
+func (s *StatsService) Motorcycles(ctx context.Context, groupBy string, filter *MotorcycleFilter) (report *MotorcycleStatisticsReport, err error) {
+  column, ok := statsGroupings[groupBy]
+  if !ok {
+    return nil, ErrInvalidGrouping
+  }
+
+  key := groupBy + "?" + filter.key()
+  now := time.Now().UTC()
+
+  s.mu.Lock()
+  entry, ok := s.cache[key]
+  s.mu.Unlock()
+
+  if ok && now.Before(entry.expiresAt) {
+    return entry.report, nil
+  }
+
+  report, err = s.aggregate(ctx, groupBy, column, filter, now)
+  if nil != err {
+    return nil, err
+  }
+
+  s.mu.Lock()
+  for k, e := range s.cache {
+    if !now.Before(e.expiresAt) {
+      delete(s.cache, k)
+    }
+  }
+
+  s.cache[key] = &statsCacheEntry{report: report, expiresAt: now.Add(s.ttl)}
+  s.mu.Unlock()
+
+  return report, nil
+}
+
+// aggregate computes the report in the database, so that its cost does not
+// grow with the catalogue in memory. The median is the mean of the one or
+// two middle prices of each group.
+func (s *StatsService) aggregate(ctx context.Context, groupBy, column string, filter *MotorcycleFilter, now time.Time) (report *MotorcycleStatisticsReport, err error) {
+  getGroupsQuery := `
+    WITH listing AS (
+         SELECT CAST(` + column + ` AS TEXT) AS bucket,
+                price,
+                mileage
+           FROM motorcycle
+          WHERE deleted_at IS NULL
+            AND status = 'active'
+            AND ` + motorcycleFilterCondition + `),
+         ranked AS (
+         SELECT bucket,
+                price,
+                row_number() OVER (PARTITION BY bucket ORDER BY price) AS position,
+                count(*) OVER (PARTITION BY bucket) AS total
+           FROM listing),
+         median AS (
+         SELECT bucket,
+                avg(price) AS price
+           FROM ranked
+          WHERE position IN ((total + 1) / 2, (total + 2) / 2)
+       GROUP BY bucket)
+  SELECT l.bucket,
+         count(*),
+         min(l.price),
+         m.price,
+         max(l.price),
+         avg(l.mileage)
+    FROM listing l
+    JOIN median m
+      ON m.bucket = l.bucket
+GROUP BY l.bucket
+ORDER BY count(*) DESC, l.bucket;`
+
+  getWeeklyCountsQuery := `
+  SELECT CAST(` + column + ` AS TEXT),
+         date(created_at, 'weekday 0', '-6 days') AS week,
+         count(*)
+    FROM motorcycle
+   WHERE deleted_at IS NULL
+     AND status = 'active'
+     AND created_at >= @since
+     AND ` + motorcycleFilterCondition + `
+GROUP BY 1, 2;`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  weekdayOffset := (int(now.Weekday()) + 6) % 7
+  currentWeek := time.Date(now.Year(), now.Month(), now.Day()-weekdayOffset, 0, 0, 0, 0, time.UTC)
+
+  weeks := make([]string, statsWeeks)
+  for i := range weeks {
+    weeks[i] = currentWeek.AddDate(0, 0, -7*(statsWeeks-1-i)).Format(time.DateOnly)
+  }
+
+  result, err := s.db.QueryContext(ctx, getGroupsQuery, filter.args()...)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  report = &MotorcycleStatisticsReport{
+    GroupBy:     groupBy,
+    GeneratedAt: now,
+    Groups:      make([]*MotorcycleStatistics, 0),
+  }
+
+  for result.Next() {
+    var (
+      statistics     MotorcycleStatistics
+      averageMileage float64
+    )
+
+    err = result.Scan(&statistics.Group, &statistics.Count, &statistics.MinPrice, &statistics.MedianPrice, &statistics.MaxPrice, &averageMileage)
+    if nil != err {
+      result.Close()
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    statistics.MinPrice = roundPrice(statistics.MinPrice)
+    statistics.MedianPrice = roundPrice(statistics.MedianPrice)
+    statistics.MaxPrice = roundPrice(statistics.MaxPrice)
+    statistics.AverageMileage = math.Round(averageMileage)
+
+    report.Groups = append(report.Groups, &statistics)
+  }
+
+  result.Close()
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  result, err = s.db.QueryContext(ctx, getWeeklyCountsQuery, append(filter.args(), sql.Named("since", weeks[0]))...)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  weekly := map[string]map[string]int{}
+
+  for result.Next() {
+    var (
+      group, week string
+      count       int
+    )
+
+    if err = result.Scan(&group, &week, &count); nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    if nil == weekly[group] {
+      weekly[group] = map[string]int{}
+    }
+
+    weekly[group][week] = count
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  for _, statistics := range report.Groups {
+    statistics.NewListingsPerWeek = make([]*WeeklyCount, 0, statsWeeks)
+
+    for _, week := range weeks {
+      statistics.NewListingsPerWeek = append(statistics.NewListingsPerWeek, &WeeklyCount{week, weekly[statistics.Group][week]})
+    }
+  }
+
+  return report, nil
+}
+
+type StatsHandler struct {
+  s *StatsService
+}
+
+func NewStatsHandler(service *StatsService) *StatsHandler {
+  return &StatsHandler{service}
+}
+
+func (h *StatsHandler) GetMotorcycles(w http.ResponseWriter, r *http.Request) {
+  groupBy := r.URL.Query().Get("group_by")
+  if "" == groupBy {
+    groupBy = "brand"
+  }
+
+  filter, err := NewMotorcycleFilter(r.URL.Query())
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidQuery)
+    return
+  }
+
+  report, err := h.s.Motorcycles(r.Context(), groupBy, filter)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(report)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // listingStreamHeartbeat is how often an idle stream sends a comment so
+  // that proxies keep the connection open.
+  listingStreamHeartbeat = 15 * time.Second
+
+  // listingSubscriberBuffer is how many events a slow client may lag
+  // behind before it is disconnected and left to resume.
+  listingSubscriberBuffer = 64
+)
+
+type ListingEvent struct {
+  ID         uint64
+  Type       string
+  Motorcycle *Motorcycle
+}
+
+// ListingBroker fans listing events out to the open streams and keeps the
+// most recent ones in a ring buffer so that clients can resume.
+type ListingBroker struct {
+  mu          sync.Mutex
+  lastID      uint64
+  ring        []*ListingEvent
+  next        int
+  subscribers map[chan *ListingEvent]struct{}
+}
+
+func NewListingBroker(size int) *ListingBroker {
+  return &ListingBroker{
+    // Ids continue from the boot time so that a client resuming after a
+    // restart is never mistaken for one that is up to date.
+    lastID:      uint64(time.Now().UnixMicro()),
+    ring:        make([]*ListingEvent, size),
+    subscribers: map[chan *ListingEvent]struct{}{},
+  }
+}
+
+// Publish broadcasts a committed change of a listing, given as the snapshot
+// recorded for it.
+func (b *ListingBroker) Publish(eventType string, snapshot map[string]any) {
+  encoded, err := json.Marshal(snapshot)
+  if nil != err {
+    slog.Error(err.Error())
+    return
+  }
+
+  motorcycle := new(Motorcycle)
+  if err = json.Unmarshal(encoded, motorcycle); nil != err {
+    slog.Error(err.Error())
+    return
+  }
+
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  b.lastID++
+  event := &ListingEvent{ID: b.lastID, Type: eventType, Motorcycle: motorcycle}
+
+  b.ring[b.next] = event
+  b.next = (b.next + 1) % len(b.ring)
+
+  for subscriber := range b.subscribers {
+    select {
+    case subscriber <- event:
+    default:
+      delete(b.subscribers, subscriber)
+      close(subscriber)
+    }
+  }
+}
+
+// Subscribe registers a stream. The events published after lastEventID are
+// returned for replay, unless some of them already left the ring buffer, in
+// which case complete is false and the client has to start over.
+func (b *ListingBroker) Subscribe(lastEventID uint64) (replay []*ListingEvent, complete bool, events chan *ListingEvent, unsubscribe func()) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  events = make(chan *ListingEvent, listingSubscriberBuffer)
+  b.subscribers[events] = struct{}{}
+
+  unsubscribe = func() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if _, ok := b.subscribers[events]; ok {
+      delete(b.subscribers, events)
+      close(events)
+    }
+  }
+
+  if 0 == lastEventID {
+    return nil, true, events, unsubscribe
+  }
+
+  expected := lastEventID + 1
+
+  for i := range b.ring {
+    event := b.ring[(b.next+i)%len(b.ring)]
+    if nil == event || event.ID <= lastEventID {
+      continue
+    }
+
+    if event.ID != expected {
+      return nil, false, events, unsubscribe
+    }
+
+    replay = append(replay, event)
+    expected++
+  }
+
+  return replay, b.lastID == expected-1, events, unsubscribe
+}
+
+// Matches tells whether a listing satisfies the filter, mirroring
+// motorcycleFilterCondition.
+func (f *MotorcycleFilter) Matches(m *Motorcycle) bool {
+  switch {
+  case "" != f.Brand && !strings.EqualFold(f.Brand, m.Brand):
+    return false
+  case "" != f.Model && !strings.EqualFold(f.Model, m.Model):
+    return false
+  case "" != f.Type && !strings.EqualFold(f.Type, m.Type):
+    return false
+  case "" != f.Color && !strings.EqualFold(f.Color, m.Color):
+    return false
+  case "" != f.Location && !strings.Contains(strings.ToLower(m.Location), strings.ToLower(f.Location)):
+    return false
+  case 0 != f.MinYear && m.Year < f.MinYear:
+    return false
+  case 0 != f.MaxYear && m.Year > f.MaxYear:
+    return false
+  case 0 != f.MinPrice && float64(m.Price) < f.MinPrice:
+    return false
+  case 0 != f.MaxPrice && float64(m.Price) > f.MaxPrice:
+    return false
+  case 0 != f.MaxMileage && m.Mileage > f.MaxMileage:
+    return false
+  }
+
+  return true
+}
+
+type ListingStreamHandler struct {
+  broker *ListingBroker
+}
+
+func NewListingStreamHandler(broker *ListingBroker) *ListingStreamHandler {
+  return &ListingStreamHandler{broker}
+}
+
+func (h *ListingStreamHandler) Stream(w http.ResponseWriter, r *http.Request) {
+  filter, err := NewMotorcycleFilter(r.URL.Query())
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidQuery)
+    return
+  }
+
+  var lastEventID uint64
+
+  if value := r.Header.Get("Last-Event-ID"); "" != value {
+    lastEventID, err = strconv.ParseUint(value, 10, 64)
+    if nil != err {
+      slog.Error(err.Error())
+      writeError(w, r, fmt.Errorf("%w: Last-Event-ID must be a number", ErrInvalidInput))
+      return
+    }
+  }
+
+  replay, complete, events, unsubscribe := h.broker.Subscribe(lastEventID)
+  defer unsubscribe()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("X-Accel-Buffering", "no")
+  w.WriteHeader(http.StatusOK)
+
+  controller := http.NewResponseController(w)
+
+  // The server write timeout would otherwise cut the stream; every write
+  // pushes the deadline past the next heartbeat instead.
+  write := func(message string) bool {
+    controller.SetWriteDeadline(time.Now().Add(2 * listingStreamHeartbeat))
+
+    if _, err := fmt.Fprint(w, message); nil != err {
+      return false
+    }
+
+    return nil == controller.Flush()
+  }
+
+  send := func(event *ListingEvent) bool {
+    if !filter.Matches(event.Motorcycle) {
+      return true
+    }
+
+    data, err := json.Marshal(event.Motorcycle)
+    if nil != err {
+      slog.Error(err.Error())
+      return true
+    }
+
+    return write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data))
+  }
+
+  if !write(fmt.Sprintf("retry: %d\n\n", (5 * time.Second).Milliseconds())) {
+    return
+  }
+
+  if !complete && !write("event: reset\ndata: {}\n\n") {
+    return
+  }
+
+  for _, event := range replay {
+    if !send(event) {
+      return
+    }
+  }
+
+  heartbeat := time.NewTicker(listingStreamHeartbeat)
+  defer heartbeat.Stop()
+
+  for {
+    select {
+    case <-r.Context().Done():
+      return
+    case event, ok := <-events:
+      if !ok || !send(event) {
+        return
+      }
+    case <-heartbeat.C:
+      if !write(": heartbeat\n\n") {
+        return
+      }
+    }
+  }
+}
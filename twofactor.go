@@ -0,0 +1,744 @@
+package main
+
+import (
+  "context"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha1"
+  "crypto/sha256"
+  "crypto/subtle"
+  "database/sql"
+  "encoding/base32"
+  "encoding/base64"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/golang-jwt/jwt/v5"
+  "log/slog"
+  "math"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  totpDigits = 6
+  totpPeriod = 30 * time.Second
+
+  // totpSkew is how many periods a code may be off by either way, for
+  // clocks that drift.
+  totpSkew = 1
+
+  recoveryCodeCount = 10
+
+  twoFactorChallengeTTL = 5 * time.Minute
+)
+
+var (
+  ErrTwoFactorAlreadyEnabled = newError(ErrConflict, "two_factor_already_enabled", "two-factor authentication already enabled")
+  ErrTwoFactorNotEnabled     = newError(ErrNotFound, "two_factor_not_enabled", "two-factor authentication not enabled")
+  ErrTwoFactorNotEnrolling   = newError(ErrNotFound, "two_factor_not_enrolling", "no two-factor enrolment to confirm")
+  ErrInvalidTwoFactorCode    = newError(ErrInvalidInput, "invalid_two_factor_code", "invalid two-factor code")
+  ErrInvalidChallenge        = newError(ErrUnauthenticated, "invalid_challenge", "invalid two-factor challenge")
+)
+
+// TOTPEnrolment is what an authenticator app needs to start generating
+// codes: the secret and, for scanning as a QR code, its otpauth URI.
+type TOTPEnrolment struct {
+  Secret string `json:"secret"`
+  URI    string `json:"uri"`
+}
+
+type TwoFactorCode struct {
+  Code string `json:"code"`
+}
+
+// TwoFactorChallenge is handed out instead of tokens by signing in with the
+// password of an account with two-factor authentication enabled.
+type TwoFactorChallenge struct {
+  ChallengeToken string `json:"challenge_token"`
+  ExpiresIn      int    `json:"expires_in"`
+}
+
+type TwoFactorSignIn struct {
+  ChallengeToken string `json:"challenge_token"`
+  Code           string `json:"code"`
+}
+
+// totpEncryptionKey encrypts TOTP secrets at rest. It is derived from
+// TOTP_ENCRYPTION_KEY, which has to be set; secrets stored while it fell back
+// to JWT_SECRET are read by setting it to that value.
+func totpEncryptionKey() ([]byte, error) {
+  secret := os.Getenv("TOTP_ENCRYPTION_KEY")
+  if "" == secret {
+    return nil, errors.New("TOTP_ENCRYPTION_KEY is not set")
+  }
+
+  digest := sha256.Sum256([]byte(secret))
+  return digest[:], nil
+}
+
+// totpCode is the RFC 6238 code of secret for the period number step.
+func totpCode(secret []byte, step int64) string {
+  message := make([]byte, 8)
+  binary.BigEndian.PutUint64(message, uint64(step))
+
+  mac := hmac.New(sha1.New, secret)
+  mac.Write(message)
+  sum := mac.Sum(nil)
+
+  offset := sum[len(sum)-1] & 0x0f
+  value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+  return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// matchTOTP returns the step code matches within the allowed skew, which
+// must be later than lastStep so that a code cannot be used twice.
+func matchTOTP(secret []byte, code string, now time.Time, lastStep int64) (step int64, ok bool) {
+  current := now.Unix() / int64(totpPeriod.Seconds())
+
+  for skew := int64(-totpSkew); skew <= totpSkew; skew++ {
+    step = current + skew
+    if step <= lastStep {
+      continue
+    }
+
+    if 1 == subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) {
+      return step, true
+    }
+  }
+
+  return 0, false
+}
+
+// normalizeRecoveryCode lets recovery codes be typed in any case, with or
+// without the dash.
+func normalizeRecoveryCode(code string) string {
+  return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+const twoFactorSnapshotQuery = `
+  SELECT user_id,
+         confirmed_at
+    FROM totp
+   WHERE user_id = @id;`
+
+type TwoFactorService struct {
+  db       *sql.DB
+  audit    *AuditService
+  sessions *SessionService
+  logins   *LoginThrottle
+  key      []byte
+  issuer   string
+}
+
+func NewTwoFactorService(db *sql.DB, audit *AuditService, sessions *SessionService, logins *LoginThrottle, key []byte, issuer string) *TwoFactorService {
+  return &TwoFactorService{db, audit, sessions, logins, key, issuer}
+}
+
+func (s *TwoFactorService) encrypt(secret []byte) (string, error) {
+  block, err := aes.NewCipher(s.key)
+  if nil != err {
+    return "", err
+  }
+
+  gcm, err := cipher.NewGCM(block)
+  if nil != err {
+    return "", err
+  }
+
+  nonce := make([]byte, gcm.NonceSize())
+  if _, err = rand.Read(nonce); nil != err {
+    return "", err
+  }
+
+  return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func (s *TwoFactorService) decrypt(encrypted string) ([]byte, error) {
+  sealed, err := base64.StdEncoding.DecodeString(encrypted)
+  if nil != err {
+    return nil, err
+  }
+
+  block, err := aes.NewCipher(s.key)
+  if nil != err {
+    return nil, err
+  }
+
+  gcm, err := cipher.NewGCM(block)
+  if nil != err {
+    return nil, err
+  }
+
+  if len(sealed) < gcm.NonceSize() {
+    return nil, errors.New("encrypted TOTP secret too short")
+  }
+
+  return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// Enabled tells whether userID has confirmed a TOTP enrolment.
+func (s *TwoFactorService) Enabled(ctx context.Context, q querier, userID int) (bool, error) {
+  var enabled bool
+
+  err := q.QueryRowContext(ctx, `SELECT count(*) > 0 FROM totp WHERE user_id = $1 AND confirmed_at IS NOT NULL;`, userID).Scan(&enabled)
+  if nil != err {
+    slog.Error(err.Error())
+    return false, err
+  }
+
+  return enabled, nil
+}
+
+// Enrol generates a new TOTP secret for userID, replacing any enrolment not
+// confirmed yet. It only takes effect once Confirm is given a code.
+func (s *TwoFactorService) Enrol(ctx context.Context, userID int) (enrolment *TOTPEnrolment, err error) {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  getEmailQuery := `
+  SELECT email
+    FROM "user"
+   WHERE id = $1
+     AND deleted_at IS NULL;`
+
+  enrolQuery := `
+  INSERT INTO totp (user_id, secret)
+            VALUES (@user_id, @secret)
+      ON CONFLICT (user_id)
+      DO UPDATE SET secret = @secret,
+                    last_used_step = 0,
+                    created_at = current_timestamp;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var email string
+
+  err = tx.QueryRowContext(ctx, getEmailQuery, userID).Scan(&email)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrUserNotFound
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  enabled, err := s.Enabled(ctx, tx, userID)
+  if nil != err {
+    return nil, err
+  }
+
+  if enabled {
+    return nil, ErrTwoFactorAlreadyEnabled
+  }
+
+  secret := make([]byte, 20)
+  if _, err = rand.Read(secret); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  encrypted, err := s.encrypt(secret)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  _, err = tx.ExecContext(ctx, enrolQuery, sql.Named("user_id", userID), sql.Named("secret", encrypted))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+
+  parameters := url.Values{}
+  parameters.Set("secret", encoded)
+  parameters.Set("issuer", s.issuer)
+  parameters.Set("algorithm", "SHA1")
+  parameters.Set("digits", strconv.Itoa(totpDigits))
+  parameters.Set("period", strconv.Itoa(int(totpPeriod.Seconds())))
+
+  uri := url.URL{
+    Scheme:   "otpauth",
+    Host:     "totp",
+    Path:     "/" + s.issuer + ":" + email,
+    RawQuery: parameters.Encode(),
+  }
+
+  return &TOTPEnrolment{Secret: encoded, URI: uri.String()}, nil
+}
+
+// Confirm enables two-factor authentication for userID once code shows the
+// authenticator app was set up, and returns the recovery codes. They are
+// only ever shown this once.
+func (s *TwoFactorService) Confirm(ctx context.Context, userID int, code string) (recoveryCodes []string, err error) {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  getEnrolmentQuery := `
+  SELECT secret, confirmed_at IS NOT NULL
+    FROM totp
+   WHERE user_id = $1;`
+
+  confirmQuery := `
+  UPDATE totp
+     SET confirmed_at = current_timestamp,
+         last_used_step = @step
+   WHERE user_id = @user_id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    encrypted string
+    confirmed bool
+  )
+
+  err = tx.QueryRowContext(ctx, getEnrolmentQuery, userID).Scan(&encrypted, &confirmed)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrTwoFactorNotEnrolling
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if confirmed {
+    return nil, ErrTwoFactorAlreadyEnabled
+  }
+
+  secret, err := s.decrypt(encrypted)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now(), 0)
+  if !ok {
+    return nil, ErrInvalidTwoFactorCode
+  }
+
+  _, err = tx.ExecContext(ctx, confirmQuery, sql.Named("user_id", userID), sql.Named("step", step))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  recoveryCodes, err = s.replaceRecoveryCodes(ctx, tx, userID)
+  if nil != err {
+    return nil, err
+  }
+
+  after, err := snapshot(ctx, tx, twoFactorSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    return nil, err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionCreate, "two_factor", userID, nil, after)
+  if nil != err {
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return recoveryCodes, nil
+}
+
+// replaceRecoveryCodes throws away the recovery codes of userID and makes
+// new ones, of which only the hashes are stored.
+func (s *TwoFactorService) replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+  deleteRecoveryCodesQuery := `
+  DELETE
+    FROM recovery_code
+   WHERE user_id = $1;`
+
+  createRecoveryCodeQuery := `
+  INSERT INTO recovery_code (user_id, code_hash)
+                     VALUES (@user_id, @code_hash);`
+
+  _, err := tx.ExecContext(ctx, deleteRecoveryCodesQuery, userID)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  codes := make([]string, 0, recoveryCodeCount)
+
+  for range recoveryCodeCount {
+    code := randomHex(5)
+
+    _, err = tx.ExecContext(ctx, createRecoveryCodeQuery,
+      sql.Named("user_id", userID),
+      sql.Named("code_hash", hashToken(code)))
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    codes = append(codes, code[:5]+"-"+code[5:])
+  }
+
+  return codes, nil
+}
+
+// verify checks code, either a TOTP code or an unused recovery code, for
+// userID and burns it.
+func (s *TwoFactorService) verify(ctx context.Context, tx *sql.Tx, userID int, code string) error {
+  getSecretQuery := `
+  SELECT secret, last_used_step
+    FROM totp
+   WHERE user_id = $1
+     AND confirmed_at IS NOT NULL;`
+
+  useStepQuery := `
+  UPDATE totp
+     SET last_used_step = @step
+   WHERE user_id = @user_id;`
+
+  useRecoveryCodeQuery := `
+  UPDATE recovery_code
+     SET used_at = current_timestamp
+   WHERE user_id = @user_id
+     AND code_hash = @code_hash
+     AND used_at IS NULL;`
+
+  var (
+    encrypted string
+    lastStep  int64
+  )
+
+  err := tx.QueryRowContext(ctx, getSecretQuery, userID).Scan(&encrypted, &lastStep)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrTwoFactorNotEnabled
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  secret, err := s.decrypt(encrypted)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now(), lastStep); ok {
+    _, err = tx.ExecContext(ctx, useStepQuery, sql.Named("user_id", userID), sql.Named("step", step))
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    return nil
+  }
+
+  result, err := tx.ExecContext(ctx, useRecoveryCodeQuery,
+    sql.Named("user_id", userID),
+    sql.Named("code_hash", hashToken(normalizeRecoveryCode(code))))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return ErrInvalidTwoFactorCode
+  }
+
+  slog.Info(fmt.Sprintf("user %d used a recovery code", userID))
+
+  return nil
+}
+
+// Disable turns two-factor authentication off for userID, given a current
+// code or a recovery code.
+func (s *TwoFactorService) Disable(ctx context.Context, userID int, code string) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  disableQueries := []string{`
+  DELETE
+    FROM recovery_code
+   WHERE user_id = $1;`, `
+  DELETE
+    FROM totp
+   WHERE user_id = $1;`,
+  }
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  if err = s.verify(ctx, tx, userID, code); nil != err {
+    return err
+  }
+
+  before, err := snapshot(ctx, tx, twoFactorSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    return err
+  }
+
+  for _, query := range disableQueries {
+    _, err = tx.ExecContext(ctx, query, userID)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionDelete, "two_factor", userID, before, nil)
+  if nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Challenge issues the token that, together with a code, completes the sign
+// in of userID on deviceName.
+func (s *TwoFactorService) Challenge(userID int, deviceName string) (*TwoFactorChallenge, error) {
+  now := time.Now()
+
+  claims := jwt.MapClaims{
+    "sub":     "two_factor",
+    "iat":     jwt.NewNumericDate(now),
+    "exp":     jwt.NewNumericDate(now.Add(twoFactorChallengeTTL)),
+    "user_id": userID,
+    "device":  deviceName,
+  }
+
+  token, err := s.sessions.keys.Sign(claims)
+  if nil != err {
+    return nil, err
+  }
+
+  return &TwoFactorChallenge{ChallengeToken: token, ExpiresIn: int(twoFactorChallengeTTL.Seconds())}, nil
+}
+
+// SignIn completes a sign in started with the password, starting a session
+// once the code is verified. Failed codes count as failed sign ins.
+func (s *TwoFactorService) SignIn(ctx context.Context, signIn *TwoFactorSignIn) (pair *TokenPair, err error) {
+  claims, err := s.sessions.keys.Parse(signIn.ChallengeToken, "two_factor")
+  if nil != err {
+    return nil, ErrInvalidChallenge
+  }
+
+  userIDClaim, ok := claims["user_id"].(float64)
+  if !ok {
+    return nil, ErrInvalidChallenge
+  }
+
+  userID := int(userIDClaim)
+  deviceName, _ := claims["device"].(string)
+
+  var email string
+
+  err = s.db.QueryRowContext(ctx, `SELECT email FROM "user" WHERE id = $1 AND deleted_at IS NULL;`, userID).Scan(&email)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrInvalidChallenge
+    }
+
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  if err = s.logins.Check(ctx, email); nil != err {
+    return nil, err
+  }
+
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer tx.Rollback()
+
+  err = s.verify(ctx, tx, userID, signIn.Code)
+  if nil != err {
+    // The failure is recorded on its own, which cannot happen while this
+    // transaction holds the database.
+    tx.Rollback()
+
+    if errors.Is(err, ErrInvalidTwoFactorCode) {
+      if err = s.logins.Fail(ctx, email, userID); nil != err {
+        return nil, err
+      }
+
+      return nil, ErrInvalidTwoFactorCode
+    }
+
+    if errors.Is(err, ErrTwoFactorNotEnabled) {
+      return nil, ErrInvalidChallenge
+    }
+
+    return nil, err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  s.logins.Succeed(ctx, email)
+
+  return s.sessions.Create(ctx, userID, deviceName)
+}
+
+type TwoFactorHandler struct {
+  s *TwoFactorService
+}
+
+func NewTwoFactorHandler(service *TwoFactorService) *TwoFactorHandler {
+  return &TwoFactorHandler{service}
+}
+
+func (h *TwoFactorHandler) Enrol(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  enrolment, err := h.s.Enrol(r.Context(), userID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(enrolment)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusCreated)
+  w.Write(response)
+}
+
+func (h *TwoFactorHandler) Confirm(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  code := TwoFactorCode{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&code)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  recoveryCodes, err := h.s.Confirm(r.Context(), userID, code.Code)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(map[string]any{"recovery_codes": recoveryCodes})
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *TwoFactorHandler) Disable(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  code := TwoFactorCode{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&code)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  err = h.s.Disable(r.Context(), userID, code.Code)
+  if nil != err {
+    // The code stands in for the password here, so a wrong one is refused
+    // rather than reported as bad input.
+    if errors.Is(err, ErrInvalidTwoFactorCode) {
+      writeProblem(w, r, http.StatusForbidden, "invalid_two_factor_code", err.Error())
+    } else {
+      writeError(w, r, err)
+    }
+
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TwoFactorHandler) SignIn(w http.ResponseWriter, r *http.Request) {
+  signIn := TwoFactorSignIn{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&signIn)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  pair, err := h.s.SignIn(r.Context(), &signIn)
+  if nil != err {
+    if errors.Is(err, ErrInvalidTwoFactorCode) {
+      writeProblem(w, r, http.StatusUnauthorized, "invalid_two_factor_code", err.Error())
+    } else {
+      writeError(w, r, err)
+    }
+
+    return
+  }
+
+  response, err := json.Marshal(pair)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusCreated)
+  w.Write(response)
+}
@@ -5,28 +5,35 @@ import (
   "database/sql"
   "encoding/json"
   "errors"
-  "github.com/golang-jwt/jwt/v5"
   "golang.org/x/crypto/bcrypt"
   "log/slog"
   "net/http"
-  "os"
   "strconv"
   "strings"
   "time"
 )
 
+// User is the full account, only shown to its owner and to admins; other
+// users see its PublicUser.
 type User struct {
-  ID          int     `json:"id"`
-  FirstName   string  `json:"first_name"`
-  MiddleName  *string `json:"middle_name"`
-  LastName    *string `json:"last_name"`
-  Surname     *string `json:"surname"`
-  Email       string  `json:"email"`
-  PhoneNumber string  `json:"phone_number"`
-  PictureURL  *string `json:"picture_url"`
-  Password    string  `json:"-"`
-  CreatedAt   string  `json:"created_at"`
-  UpdatedAt   string  `json:"updated_at"`
+  ID                  int     `json:"id"`
+  FirstName           string  `json:"first_name"`
+  MiddleName          *string `json:"middle_name"`
+  LastName            *string `json:"last_name"`
+  Surname             *string `json:"surname"`
+  Email               string  `json:"email"`
+  PhoneNumber         string  `json:"phone_number"`
+  PictureURL          *string `json:"picture_url"`
+  Password            string  `json:"-"`
+  Role                string  `json:"role"`
+  Locale              string  `json:"locale"`
+  ShowPhoneOnListings bool    `json:"show_phone_on_listings"`
+  ShowEmailOnListings bool    `json:"show_email_on_listings"`
+  RevealPhone         bool    `json:"reveal_phone"`
+  RevealEmail         bool    `json:"reveal_email"`
+  EmailVerifiedAt     *string `json:"email_verified_at"`
+  CreatedAt           string  `json:"created_at"`
+  UpdatedAt           string  `json:"updated_at"`
 }
 
 type UserCreation struct {
@@ -37,33 +44,166 @@ type UserCreation struct {
   Email       string `json:"email"`
   PhoneNumber string `json:"phone_number"`
   Password    string `json:"password"`
+  Locale      string `json:"locale"`
 }
 
+// UserUpdate changes the fields that are set. The contact settings are
+// pointers, as false is a value to change them to. Password is only there to
+// be refused, as it is changed through POST /me/password.
 type UserUpdate struct {
-  FirstName   string `json:"first_name"`
-  MiddleName  string `json:"middle_name"`
-  LastName    string `json:"last_name"`
-  Surname     string `json:"surname"`
-  Email       string `json:"email"`
-  PhoneNumber string `json:"phone_number"`
-  Password    string `json:"password"`
-  PictureURL  string `json:"picture_url"`
+  FirstName           string  `json:"first_name"`
+  MiddleName          string  `json:"middle_name"`
+  LastName            string  `json:"last_name"`
+  Surname             string  `json:"surname"`
+  Email               string  `json:"email"`
+  PhoneNumber         string  `json:"phone_number"`
+  PictureURL          string  `json:"picture_url"`
+  Locale              string  `json:"locale"`
+  ShowPhoneOnListings *bool   `json:"show_phone_on_listings"`
+  ShowEmailOnListings *bool   `json:"show_email_on_listings"`
+  RevealPhone         *bool   `json:"reveal_phone"`
+  RevealEmail         *bool   `json:"reveal_email"`
+  Password            *string `json:"password"`
+}
+
+// validate checks c against the columns it is stored in. The password is
+// checked against the policy by the service.
+func (c *UserCreation) validate() *validator {
+  v := &validator{}
+
+  v.required("first_name", c.FirstName)
+  v.maxLength("first_name", c.FirstName, 64)
+  v.maxLength("middle_name", c.MiddleName, 64)
+  v.maxLength("last_name", c.LastName, 64)
+  v.maxLength("surname", c.Surname, 64)
+  v.required("email", c.Email)
+  v.maxLength("email", c.Email, 240)
+  v.email("email", c.Email)
+  v.required("phone_number", c.PhoneNumber)
+  v.maxLength("phone_number", c.PhoneNumber, 64)
+  v.phoneNumber("phone_number", c.PhoneNumber)
+  v.required("password", c.Password)
+
+  return v
+}
+
+// validate checks the fields being changed; empty ones are left as they
+// are.
+func (u *UserUpdate) validate() *validator {
+  v := &validator{}
+
+  v.maxLength("first_name", u.FirstName, 64)
+  v.maxLength("middle_name", u.MiddleName, 64)
+  v.maxLength("last_name", u.LastName, 64)
+  v.maxLength("surname", u.Surname, 64)
+  v.maxLength("email", u.Email, 240)
+  v.email("email", u.Email)
+  v.maxLength("phone_number", u.PhoneNumber, 64)
+  v.phoneNumber("phone_number", u.PhoneNumber)
+  v.maxLength("picture_url", u.PictureURL, 2048)
+  v.httpURL("picture_url", u.PictureURL)
+
+  if nil != u.Password {
+    v.add("password", FieldNotAllowed, "is changed through POST /me/password")
+  }
+
+  return v
+}
+
+// locale is the normalized locale to switch to, or empty to keep the
+// current one.
+func (u *UserUpdate) locale() string {
+  if "" == strings.TrimSpace(u.Locale) {
+    return ""
+  }
+
+  return normalizeLocale(u.Locale)
 }
 
 type UserCredentials struct {
-  Email    string `json:"email"`
-  Password string `json:"password"`
+  Email      string `json:"email"`
+  Password   string `json:"password"`
+  DeviceName string `json:"device_name"`
 }
 
+var (
+  ErrUserNotFound         = newError(ErrNotFound, "user_not_found", "user not found")
+  ErrRestorePeriodExpired = newError(ErrGone, "restore_period_expired", "restore period expired")
+  ErrEmailTaken           = newError(ErrConflict, "email_taken", "email already in use")
+  ErrPhoneNumberTaken     = newError(ErrConflict, "phone_number_taken", "phone number already in use")
+  ErrWrongPassword        = newError(ErrForbidden, "wrong_password", "current password is wrong")
+)
+
+// userConflict returns which unique field of the user err was refused
+// for, or nil when it was refused for something else.
+func userConflict(err error) error {
+  switch column, _ := uniqueViolation(err); column {
+  case "user.email":
+    return ErrEmailTaken
+  case "user.phone_number":
+    return ErrPhoneNumberTaken
+  default:
+    return nil
+  }
+}
+
+const userSnapshotQuery = `
+  SELECT id,
+         first_name,
+         middle_name,
+         last_name,
+         surname,
+         email,
+         phone_number,
+         picture_url,
+         password,
+         role,
+         locale,
+         show_phone_on_listings,
+         show_email_on_listings,
+         reveal_phone,
+         reveal_email,
+         email_verified_at,
+         deleted_at
+    FROM "user"
+   WHERE id = @id;`
+
 type UserService struct {
-  db *sql.DB
+  db                  *sql.DB
+  audit               *AuditService
+  webhooks            *WebhookService
+  emails              *EmailService
+  verifications       *EmailVerificationService
+  listings            *ListingBroker
+  sessions            *SessionService
+  logins              *LoginThrottle
+  twoFactor           *TwoFactorService
+  passwords           PasswordPolicy
+  deletionGracePeriod time.Duration
 }
 
-func NewUserService(db *sql.DB) *UserService {
-  return &UserService{db}
+func NewUserService(db *sql.DB, audit *AuditService, webhooks *WebhookService, emails *EmailService, verifications *EmailVerificationService, listings *ListingBroker, sessions *SessionService, logins *LoginThrottle, twoFactor *TwoFactorService, passwords PasswordPolicy, deletionGracePeriod time.Duration) *UserService {
+  return &UserService{db, audit, webhooks, emails, verifications, listings, sessions, logins, twoFactor, passwords, deletionGracePeriod}
 }
 
 func (s *UserService) SignUp(ctx context.Context, credentials *UserCreation) (insertedID int, err error) {
+  v := credentials.validate()
+
+  if err = s.passwords.Validate(credentials.Password, credentials.Email); nil != err {
+    var policyErr *PasswordPolicyError
+    if !errors.As(err, &policyErr) {
+      return 0, err
+    }
+
+    if !v.failed("password") {
+      v.add("password", FieldWeakPassword, policyErr.Reason)
+    }
+  }
+
+  if err = v.err(); nil != err {
+    return 0, err
+  }
+
   tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
   if nil != err {
     slog.Error(err.Error())
@@ -73,13 +213,12 @@ func (s *UserService) SignUp(ctx context.Context, credentials *UserCreation) (in
   defer tx.Rollback()
 
   registerUserQuery := `
-  INSERT INTO "user" (first_name, middle_name, last_name, surname, email, phone_number, password)
-              VALUES (@first_name, @middle_name, @last_name, @surname, @email, @phone_number, @password)
+  INSERT INTO "user" (first_name, middle_name, last_name, surname, email, phone_number, password, locale)
+              VALUES (@first_name, @middle_name, @last_name, @surname, @email, @phone_number, @password, @locale)
     RETURNING id;`
 
-  hashedPassword, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.MinCost)
+  hashedPassword, err := s.passwords.Hash(credentials.Password)
   if nil != err {
-    slog.Error(err.Error())
     return 0, err
   }
 
@@ -93,14 +232,40 @@ func (s *UserService) SignUp(ctx context.Context, credentials *UserCreation) (in
     sql.Named("surname", strings.TrimSpace(credentials.Surname)),
     sql.Named("email", strings.TrimSpace(credentials.Email)),
     sql.Named("phone_number", strings.TrimSpace(credentials.PhoneNumber)),
-    sql.Named("password", hashedPassword)).
+    sql.Named("password", hashedPassword),
+    sql.Named("locale", normalizeLocale(credentials.Locale))).
     Scan(&insertedID)
 
   if nil != err {
+    if conflictErr := userConflict(err); nil != conflictErr {
+      return 0, conflictErr
+    }
+
     slog.Error(err.Error())
     return 0, err
   }
 
+  after, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", insertedID))
+  if nil != err {
+    return 0, err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionCreate, "user", insertedID, nil, after)
+  if nil != err {
+    return 0, err
+  }
+
+  err = s.emails.Enqueue(ctx, tx, strings.TrimSpace(credentials.Email), "welcome", credentials.Locale, map[string]any{
+    "first_name": strings.TrimSpace(credentials.FirstName),
+  })
+  if nil != err {
+    return 0, err
+  }
+
+  if err = s.verifications.Send(ctx, tx, insertedID); nil != err {
+    return 0, err
+  }
+
   if err = tx.Commit(); nil != err {
     slog.Error(err.Error())
     return 0, err
@@ -109,53 +274,181 @@ func (s *UserService) SignUp(ctx context.Context, credentials *UserCreation) (in
   return insertedID, nil
 }
 
-func (s *UserService) SignIn(ctx context.Context, credentials *UserCredentials) (token string, err error) {
+func (s *UserService) SignIn(ctx context.Context, credentials *UserCredentials) (pair *TokenPair, challenge *TwoFactorChallenge, err error) {
   getUserPasswordQuery := `
   SELECT id, password
     FROM "user"
-   WHERE email = @email;`
+   WHERE email = @email
+     AND deleted_at IS NULL;`
 
   var (
     userID        int
     savedPassword string
   )
 
-  err = s.db.QueryRowContext(ctx, getUserPasswordQuery, sql.Named("email", credentials.Email)).Scan(&userID, &savedPassword)
-  if nil != err {
+  if err = s.logins.Check(ctx, credentials.Email); nil != err {
+    return nil, nil, err
+  }
+
+  err = s.db.QueryRowContext(ctx, getUserPasswordQuery, sql.Named("email", strings.TrimSpace(credentials.Email))).Scan(&userID, &savedPassword)
+  if nil != err && !errors.Is(err, sql.ErrNoRows) {
     slog.Error(err.Error())
-    return "", err
+    return nil, nil, err
+  }
+
+  if "" == savedPassword {
+    // Hashing costs as much as comparing, so unknown emails and accounts
+    // without a password take as long to reject as a wrong password.
+    s.passwords.Hash(credentials.Password)
+    err = bcrypt.ErrMismatchedHashAndPassword
+  } else {
+    err = bcrypt.CompareHashAndPassword([]byte(savedPassword), []byte(credentials.Password))
   }
 
-  err = bcrypt.CompareHashAndPassword([]byte(savedPassword), []byte(credentials.Password))
   if nil != err {
     if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
       slog.Error(err.Error())
     }
 
-    return "", err
+    if err = s.logins.Fail(ctx, credentials.Email, userID); nil != err {
+      return nil, nil, err
+    }
+
+    return nil, nil, ErrInvalidCredentials
+  }
+
+  s.logins.Succeed(ctx, credentials.Email)
+
+  if s.passwords.Outdated(savedPassword) {
+    s.rehash(ctx, userID, credentials.Password)
+  }
+
+  enabled, err := s.twoFactor.Enabled(ctx, s.db, userID)
+  if nil != err {
+    return nil, nil, err
+  }
+
+  if enabled {
+    challenge, err = s.twoFactor.Challenge(userID, credentials.DeviceName)
+    return nil, challenge, err
   }
 
-  claims := jwt.MapClaims{
-    "iss":     "noda",
-    "sub":     "authentication",
-    "iat":     jwt.NewNumericDate(time.Now()),
-    "exp":     jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-    "user_id": userID,
+  pair, err = s.sessions.Create(ctx, userID, credentials.DeviceName)
+  return pair, nil, err
+}
+
+// rehash stores password again with the current cost. Failing to do so is
+// not a reason to refuse the sign in, so errors are only logged.
+func (s *UserService) rehash(ctx context.Context, id int, password string) {
+  rehashPasswordQuery := `
+  UPDATE "user"
+     SET password = @password
+   WHERE id = @id;`
+
+  hashedPassword, err := s.passwords.Hash(password)
+  if nil != err {
+    return
   }
 
-  t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-  secret := os.Getenv("JWT_SECRET")
-  if "" == secret {
-    secret = "default secret"
+  _, err = s.db.ExecContext(ctx, rehashPasswordQuery, sql.Named("id", id), sql.Named("password", hashedPassword))
+  if nil != err {
+    slog.Error(err.Error())
   }
+}
 
-  ss, err := t.SignedString([]byte(secret))
+// ChangePassword replaces the password of user id once the current one is
+// confirmed. Every other session of the user is revoked; sessionID, the one
+// making the change, is kept.
+func (s *UserService) ChangePassword(ctx context.Context, id, sessionID int, change *PasswordChange) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
   if nil != err {
     slog.Error(err.Error())
-    return "", err
+    return err
   }
 
-  return ss, nil
+  defer tx.Rollback()
+
+  getUserPasswordQuery := `
+  SELECT email, password
+    FROM "user"
+   WHERE id = $1
+     AND deleted_at IS NULL;`
+
+  changePasswordQuery := `
+  UPDATE "user"
+     SET password = @password,
+         updated_at = current_timestamp
+   WHERE id = @id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  var email, savedPassword string
+
+  err = tx.QueryRowContext(ctx, getUserPasswordQuery, id).Scan(&email, &savedPassword)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrUserNotFound
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  err = bcrypt.CompareHashAndPassword([]byte(savedPassword), []byte(change.CurrentPassword))
+  if nil != err {
+    if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+      return ErrWrongPassword
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  if change.NewPassword == change.CurrentPassword {
+    return &PasswordPolicyError{"must differ from the current one"}
+  }
+
+  if err = s.passwords.Validate(change.NewPassword, email); nil != err {
+    return err
+  }
+
+  hashedPassword, err := s.passwords.Hash(change.NewPassword)
+  if nil != err {
+    return err
+  }
+
+  before, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    return err
+  }
+
+  _, err = tx.ExecContext(ctx, changePasswordQuery, sql.Named("id", id), sql.Named("password", hashedPassword))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  after, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionUpdate, "user", id, before, after)
+  if nil != err {
+    return err
+  }
+
+  if err = s.sessions.RevokeAll(ctx, tx, id, sessionID); nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
 }
 
 func (s *UserService) GetByID(ctx context.Context, id int) (user *User, err error) {
@@ -169,10 +462,18 @@ func (s *UserService) GetByID(ctx context.Context, id int) (user *User, err erro
          phone_number,
          picture_url,
          password,
+         role,
+         locale,
+         show_phone_on_listings,
+         show_email_on_listings,
+         reveal_phone,
+         reveal_email,
+         email_verified_at,
          created_at,
          updated_at
     FROM "user"
-   WHERE id = $1;`
+   WHERE id = $1
+     AND deleted_at IS NULL;`
 
   ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
   defer cancel()
@@ -191,11 +492,22 @@ func (s *UserService) GetByID(ctx context.Context, id int) (user *User, err erro
     &user.PhoneNumber,
     &user.PictureURL,
     &user.Password,
+    &user.Role,
+    &user.Locale,
+    &user.ShowPhoneOnListings,
+    &user.ShowEmailOnListings,
+    &user.RevealPhone,
+    &user.RevealEmail,
+    &user.EmailVerifiedAt,
     &user.CreatedAt,
     &user.UpdatedAt,
   )
 
   if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return nil, ErrUserNotFound
+    }
+
     slog.Error(err.Error())
     return nil, err
   }
@@ -203,6 +515,29 @@ func (s *UserService) GetByID(ctx context.Context, id int) (user *User, err erro
   return user, nil
 }
 
+func (s *UserService) GetRole(ctx context.Context, id int) (role string, err error) {
+  getUserRoleQuery := `
+  SELECT role
+    FROM "user"
+   WHERE id = $1
+     AND deleted_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  err = s.db.QueryRowContext(ctx, getUserRoleQuery, id).Scan(&role)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return "", ErrUserNotFound
+    }
+
+    slog.Error(err.Error())
+    return "", err
+  }
+
+  return role, nil
+}
+
 func (s *UserService) Get(ctx context.Context, page int) (users []*User, err error) {
   getUsersQuery := `
   SELECT id,
@@ -213,9 +548,17 @@ func (s *UserService) Get(ctx context.Context, page int) (users []*User, err err
          email,
          phone_number,
          picture_url,
+         role,
+         locale,
+         show_phone_on_listings,
+         show_email_on_listings,
+         reveal_phone,
+         reveal_email,
+         email_verified_at,
          created_at,
          updated_at
     FROM "user"
+   WHERE deleted_at IS NULL
 ORDER BY created_at
    LIMIT 10
    OFFSET 10 * (@page - 1);`
@@ -243,6 +586,13 @@ ORDER BY created_at
       &user.Email,
       &user.PhoneNumber,
       &user.PictureURL,
+      &user.Role,
+      &user.Locale,
+      &user.ShowPhoneOnListings,
+      &user.ShowEmailOnListings,
+      &user.RevealPhone,
+      &user.RevealEmail,
+      &user.EmailVerifiedAt,
       &user.CreatedAt,
       &user.UpdatedAt,
     )
@@ -259,6 +609,10 @@ ORDER BY created_at
 }
 
 func (s *UserService) Update(ctx context.Context, id int, update *UserUpdate) error {
+  if err := update.validate().err(); nil != err {
+    return err
+  }
+
   tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
   if nil != err {
     slog.Error(err.Error())
@@ -274,15 +628,30 @@ func (s *UserService) Update(ctx context.Context, id int, update *UserUpdate) er
          last_name = coalesce(nullif(@last_name, ''), last_name),
          surname = coalesce(nullif(@surname, ''), surname),
          email = coalesce(nullif(@email, ''), email),
+         email_verified_at = CASE WHEN coalesce(nullif(@email, ''), email) = email THEN email_verified_at END,
          phone_number = coalesce(nullif(@phone_number, ''), phone_number),
          picture_url = coalesce(nullif(@picture_url, ''), picture_url),
-         password = coalesce(nullif(@password, ''), password),
+         locale = coalesce(nullif(@locale, ''), locale),
+         show_phone_on_listings = coalesce(@show_phone_on_listings, show_phone_on_listings),
+         show_email_on_listings = coalesce(@show_email_on_listings, show_email_on_listings),
+         reveal_phone = coalesce(@reveal_phone, reveal_phone),
+         reveal_email = coalesce(@reveal_email, reveal_email),
          updated_at = current_timestamp
-   WHERE id = @id;`
+   WHERE id = @id
+     AND deleted_at IS NULL;`
 
   ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
   defer cancel()
 
+  before, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrUserNotFound
+    }
+
+    return err
+  }
+
   result, err := tx.ExecContext(ctx, updateUserQuery,
     sql.Named("id", id),
     sql.Named("first_name", strings.TrimSpace(update.FirstName)),
@@ -292,16 +661,45 @@ func (s *UserService) Update(ctx context.Context, id int, update *UserUpdate) er
     sql.Named("email", strings.TrimSpace(update.Email)),
     sql.Named("phone_number", strings.TrimSpace(update.PhoneNumber)),
     sql.Named("picture_url", strings.TrimSpace(update.PictureURL)),
-    sql.Named("password", strings.TrimSpace(update.Password)),
+    sql.Named("locale", update.locale()),
+    sql.Named("show_phone_on_listings", update.ShowPhoneOnListings),
+    sql.Named("show_email_on_listings", update.ShowEmailOnListings),
+    sql.Named("reveal_phone", update.RevealPhone),
+    sql.Named("reveal_email", update.RevealEmail),
   )
 
   if nil != err {
+    if conflictErr := userConflict(err); nil != conflictErr {
+      return conflictErr
+    }
+
     slog.Error(err.Error())
     return err
   }
 
   if affected, _ := result.RowsAffected(); 1 != affected {
-    return errors.New("user not found")
+    return ErrUserNotFound
+  }
+
+  after, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionUpdate, "user", id, before, after)
+  if nil != err {
+    return err
+  }
+
+  err = s.webhooks.Enqueue(ctx, tx, id, EventUserUpdated, after)
+  if nil != err {
+    return err
+  }
+
+  if before["email"] != after["email"] {
+    if err = s.verifications.Send(ctx, tx, id); nil != err {
+      return err
+    }
   }
 
   if err = tx.Commit(); nil != err {
@@ -322,21 +720,298 @@ func (s *UserService) Delete(ctx context.Context, id int) error {
   defer tx.Rollback()
 
   deleteUserQuery := `
-  DELETE
-    FROM "user"
-   WHERE id = $1;`
+  UPDATE "user"
+     SET deleted_at = @deleted_at
+   WHERE id = @id
+     AND deleted_at IS NULL;`
+
+  deleteUserMotorcyclesQuery := `
+  UPDATE motorcycle
+     SET deleted_at = @deleted_at
+   WHERE owner_id = @id
+     AND deleted_at IS NULL
+    RETURNING id;`
 
   ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
   defer cancel()
 
-  result, err := tx.ExecContext(ctx, deleteUserQuery, id)
+  // Listings share the account's deletion time so that restoring the
+  // account brings back exactly the listings that went away with it.
+  deletedAt := sql.Named("deleted_at", time.Now().UTC().Format(time.DateTime))
+
+  before, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrUserNotFound
+    }
+
+    return err
+  }
+
+  result, err := tx.ExecContext(ctx, deleteUserQuery, sql.Named("id", id), deletedAt)
   if nil != err {
     slog.Error(err.Error())
     return err
   }
 
   if affected, _ := result.RowsAffected(); 1 != affected {
-    return errors.New("user not found")
+    return ErrUserNotFound
+  }
+
+  after, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", id))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionDelete, "user", id, before, after)
+  if nil != err {
+    return err
+  }
+
+  err = s.webhooks.Enqueue(ctx, tx, id, EventUserDeleted, after)
+  if nil != err {
+    return err
+  }
+
+  // Restoring the account must not bring its sessions back.
+  if err = s.sessions.RevokeAll(ctx, tx, id, 0); nil != err {
+    return err
+  }
+
+  motorcycles, err := motorcycleSnapshots(ctx, tx, deleteUserMotorcyclesQuery, sql.Named("id", id), deletedAt)
+  if nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, motorcycle := range motorcycles {
+    s.listings.Publish(EventMotorcycleDeleted, motorcycle)
+  }
+
+  return nil
+}
+
+func (s *UserService) Restore(ctx context.Context, credentials *UserCredentials) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  getDeletedUserQuery := `
+  SELECT id, password, deleted_at
+    FROM "user"
+   WHERE email = @email
+     AND deleted_at IS NOT NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  var (
+    userID        int
+    savedPassword string
+    deletedAt     string
+  )
+
+  err = tx.QueryRowContext(ctx, getDeletedUserQuery, sql.Named("email", strings.TrimSpace(credentials.Email))).
+    Scan(&userID, &savedPassword, &deletedAt)
+  if nil != err {
+    // Unknown and active accounts answer like a wrong password, so that
+    // restoring does not tell which emails belong to deleted accounts.
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrInvalidCredentials
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  err = bcrypt.CompareHashAndPassword([]byte(savedPassword), []byte(credentials.Password))
+  if nil != err {
+    if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+      return ErrInvalidCredentials
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  if deletedAt < time.Now().UTC().Add(-s.deletionGracePeriod).Format(time.DateTime) {
+    return ErrRestorePeriodExpired
+  }
+
+  restoreUserQuery := `
+  UPDATE "user"
+     SET deleted_at = NULL
+   WHERE id = @id;`
+
+  restoreUserMotorcyclesQuery := `
+  UPDATE motorcycle
+     SET deleted_at = NULL
+   WHERE owner_id = @id
+     AND deleted_at = @deleted_at
+    RETURNING id;`
+
+  before, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    return err
+  }
+
+  _, err = tx.ExecContext(ctx, restoreUserQuery, sql.Named("id", userID))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  after, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionRestore, "user", userID, before, after)
+  if nil != err {
+    return err
+  }
+
+  motorcycles, err := motorcycleSnapshots(ctx, tx, restoreUserMotorcyclesQuery, sql.Named("id", userID), sql.Named("deleted_at", deletedAt))
+  if nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, motorcycle := range motorcycles {
+    s.listings.Publish(EventMotorcycleRestored, motorcycle)
+  }
+
+  return nil
+}
+
+// Purge permanently deletes the accounts whose grace period is over,
+// together with their listings, images, favorites, notifications, webhooks
+// and pending verification and password reset links. Their audit entries
+// are kept, but without the snapshots and addresses they recorded.
+func (s *UserService) Purge(ctx context.Context) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  purgeQueries := []string{`
+  UPDATE audit_log
+     SET changes = '{}'
+   WHERE (entity_type IN ('user', 'two_factor')
+          AND entity_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff))
+      OR (entity_type = 'motorcycle'
+          AND entity_id IN (SELECT m.id
+                              FROM motorcycle m
+                              JOIN "user" u ON u.id = m.owner_id
+                             WHERE u.deleted_at < @cutoff))
+      OR (entity_type = 'api_key'
+          AND entity_id IN (SELECT k.id
+                              FROM api_key k
+                              JOIN "user" u ON u.id = k.user_id
+                             WHERE u.deleted_at < @cutoff))
+      OR (entity_type = 'data_export'
+          AND entity_id IN (SELECT e.id
+                              FROM data_export e
+                              JOIN "user" u ON u.id = e.user_id
+                             WHERE u.deleted_at < @cutoff));`, `
+  UPDATE audit_log
+     SET ip = NULL
+   WHERE actor_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM favorite
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff)
+      OR motorcycle_id IN (SELECT m.id
+                             FROM motorcycle m
+                             JOIN "user" u ON u.id = m.owner_id
+                            WHERE u.deleted_at < @cutoff);`, `
+  DELETE
+    FROM contact_reveal
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff)
+      OR motorcycle_id IN (SELECT m.id
+                             FROM motorcycle m
+                             JOIN "user" u ON u.id = m.owner_id
+                            WHERE u.deleted_at < @cutoff);`, `
+  DELETE
+    FROM motorcycle_image
+   WHERE motorcycle_id IN (SELECT m.id
+                             FROM motorcycle m
+                             JOIN "user" u ON u.id = m.owner_id
+                            WHERE u.deleted_at < @cutoff);`, `
+  DELETE
+    FROM motorcycle
+   WHERE owner_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM email_verification
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM password_reset
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM notification
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM refresh_token
+   WHERE session_id IN (SELECT s.id
+                          FROM session s
+                          JOIN "user" u
+                            ON u.id = s.user_id
+                         WHERE u.deleted_at < @cutoff);`, `
+  DELETE
+    FROM session
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM recovery_code
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM totp
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM api_key
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM data_export
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM webhook_delivery
+   WHERE subscription_id IN (SELECT w.id
+                               FROM webhook_subscription w
+                               JOIN "user" u
+                                 ON u.id = w.user_id
+                              WHERE u.deleted_at < @cutoff);`, `
+  DELETE
+    FROM webhook_subscription
+   WHERE user_id IN (SELECT id FROM "user" WHERE deleted_at < @cutoff);`, `
+  DELETE
+    FROM "user"
+   WHERE deleted_at < @cutoff;`,
+  }
+
+  ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+  defer cancel()
+
+  cutoff := sql.Named("cutoff", time.Now().UTC().Add(-s.deletionGracePeriod).Format(time.DateTime))
+
+  for _, query := range purgeQueries {
+    _, err = tx.ExecContext(ctx, query, cutoff)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
   }
 
   if err = tx.Commit(); nil != err {
@@ -348,11 +1023,12 @@ func (s *UserService) Delete(ctx context.Context, id int) error {
 }
 
 type UserHandler struct {
-  s *UserService
+  s             *UserService
+  notifications *NotificationService
 }
 
-func NewUserHandler(service *UserService) *UserHandler {
-  return &UserHandler{service}
+func NewUserHandler(service *UserService, notifications *NotificationService) *UserHandler {
+  return &UserHandler{service, notifications}
 }
 
 func (h *UserHandler) SignUp(w http.ResponseWriter, r *http.Request) {
@@ -362,14 +1038,13 @@ func (h *UserHandler) SignUp(w http.ResponseWriter, r *http.Request) {
   err := decoder.Decode(&userCreation)
   if err != nil {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, ErrMalformedBody)
     return
   }
 
-  insertedID, err := h.s.SignUp(context.TODO(), &userCreation)
+  insertedID, err := h.s.SignUp(r.Context(), &userCreation)
   if err != nil {
-    slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
@@ -384,18 +1059,40 @@ func (h *UserHandler) SignIn(w http.ResponseWriter, r *http.Request) {
   err := decoder.Decode(&credentials)
   if err != nil {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, ErrMalformedBody)
     return
   }
 
-  token, err := h.s.SignIn(r.Context(), &credentials)
+  pair, challenge, err := h.s.SignIn(r.Context(), &credentials)
   if err != nil {
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
+    return
+  }
+
+  // With two-factor authentication enabled, the tokens come from
+  // POST /login/2fa instead.
+  if nil != challenge {
+    response, err := json.Marshal(challenge)
+    if nil != err {
+      slog.Error(err.Error())
+      writeError(w, r, err)
+      return
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write(response)
+    return
+  }
+
+  response, err := json.Marshal(pair)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
     return
   }
 
   w.WriteHeader(http.StatusCreated)
-  w.Write([]byte(`{"token":"` + token + `"}`))
+  w.Write(response)
 }
 
 func (h *UserHandler) GetByID(w http.ResponseWriter, r *http.Request) {
@@ -404,25 +1101,34 @@ func (h *UserHandler) GetByID(w http.ResponseWriter, r *http.Request) {
   userID, err := strconv.Atoi(userIDStr)
   if nil != err {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, ErrInvalidID)
     return
   }
 
-  user, err := h.s.GetByID(r.Context(), userID)
-  if nil != err {
-    if errors.Is(err, sql.ErrNoRows) {
-      w.WriteHeader(http.StatusNotFound)
-    } else {
-      w.WriteHeader(http.StatusInternalServerError)
-    }
+  principal := principalFrom(r.Context())
+  if userID == principal.UserID {
+    h.GetMe(w, r)
+    return
+  }
+
+  // Only admins get to see the contact details of other users.
+  var user any
+
+  if principal.HasRole("admin") {
+    user, err = h.s.GetByID(r.Context(), userID)
+  } else {
+    user, err = h.s.GetProfile(r.Context(), userID)
+  }
 
+  if nil != err {
+    writeError(w, r, err)
     return
   }
 
   response, err := json.Marshal(user)
   if nil != err {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
@@ -431,23 +1137,27 @@ func (h *UserHandler) GetByID(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
-  userID := r.Context().Value("user_id").(int)
+  userID := principalFrom(r.Context()).UserID
 
   user, err := h.s.GetByID(r.Context(), userID)
   if nil != err {
-    if errors.Is(err, sql.ErrNoRows) {
-      w.WriteHeader(http.StatusNotFound)
-    } else {
-      w.WriteHeader(http.StatusInternalServerError)
-    }
+    writeError(w, r, err)
+    return
+  }
 
+  unread, err := h.notifications.CountUnread(r.Context(), userID)
+  if nil != err {
+    writeError(w, r, err)
     return
   }
 
-  response, err := json.Marshal(user)
+  response, err := json.Marshal(struct {
+    *User
+    UnreadNotifications int `json:"unread_notifications"`
+  }{user, unread})
   if nil != err {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
@@ -465,21 +1175,28 @@ func (h *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
     page, err = strconv.Atoi(pageStr)
     if nil != err {
       slog.Error(err.Error())
-      w.WriteHeader(http.StatusInternalServerError)
+      writeError(w, r, ErrInvalidQuery)
       return
     }
   }
 
-  users, err := h.s.Get(r.Context(), page)
+  var users any
+
+  if principalFrom(r.Context()).HasRole("admin") {
+    users, err = h.s.Get(r.Context(), page)
+  } else {
+    users, err = h.s.GetProfiles(r.Context(), page)
+  }
+
   if nil != err {
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
   response, err := json.Marshal(users)
   if nil != err {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, err)
     return
   }
 
@@ -488,25 +1205,42 @@ func (h *UserHandler) Get(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *UserHandler) UpdateMe(w http.ResponseWriter, r *http.Request) {
-  userID := r.Context().Value("user_id").(int)
+  userID := principalFrom(r.Context()).UserID
   userUpdate := UserUpdate{}
 
   decoder := json.NewDecoder(r.Body)
   err := decoder.Decode(&userUpdate)
   if nil != err {
     slog.Error(err.Error())
-    w.WriteHeader(http.StatusInternalServerError)
+    writeError(w, r, ErrMalformedBody)
     return
   }
 
   err = h.s.Update(r.Context(), userID, &userUpdate)
   if nil != err {
-    if strings.Contains(err.Error(), "user not found") {
-      w.WriteHeader(http.StatusNotFound)
-    } else {
-      w.WriteHeader(http.StatusInternalServerError)
-    }
+    writeError(w, r, err)
+    return
+  }
 
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  sessionID := principalFrom(r.Context()).SessionID
+  change := PasswordChange{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&change)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  err = h.s.ChangePassword(r.Context(), userID, sessionID, &change)
+  if nil != err {
+    writeError(w, r, err)
     return
   }
 
@@ -514,16 +1248,31 @@ func (h *UserHandler) UpdateMe(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *UserHandler) DeleteMe(w http.ResponseWriter, r *http.Request) {
-  userID := r.Context().Value("user_id").(int)
+  userID := principalFrom(r.Context()).UserID
 
   err := h.s.Delete(r.Context(), userID)
   if nil != err {
-    if strings.Contains(err.Error(), "user not found") {
-      w.WriteHeader(http.StatusNotFound)
-    } else {
-      w.WriteHeader(http.StatusInternalServerError)
-    }
+    writeError(w, r, err)
+    return
+  }
 
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) Restore(w http.ResponseWriter, r *http.Request) {
+  credentials := UserCredentials{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&credentials)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  err = h.s.Restore(r.Context(), &credentials)
+  if nil != err {
+    writeError(w, r, err)
     return
   }
 
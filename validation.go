@@ -0,0 +1,171 @@
+package main
+
+import (
+  "fmt"
+  "net/mail"
+  "net/url"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+const (
+  FieldRequired      = "required"
+  FieldTooLong       = "too_long"
+  FieldInvalidFormat = "invalid_format"
+  FieldOutOfRange    = "out_of_range"
+  FieldNotAllowed    = "not_allowed"
+  FieldWeakPassword  = "weak_password"
+)
+
+// FieldError is what is wrong with a single field of a request.
+type FieldError struct {
+  Field   string `json:"field"`
+  Code    string `json:"code"`
+  Message string `json:"message"`
+}
+
+// ValidationError lists every rejected field of a request, so that clients
+// can show each message next to its input.
+type ValidationError struct {
+  Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+  fields := make([]string, 0, len(e.Errors))
+  for _, fieldErr := range e.Errors {
+    fields = append(fields, fieldErr.Field+" "+fieldErr.Code)
+  }
+
+  return "invalid fields: " + strings.Join(fields, ", ")
+}
+
+// validator collects field errors. Its checks skip fields that already
+// failed, so that every field reports its first problem only.
+type validator struct {
+  errors []FieldError
+}
+
+func (v *validator) add(field, code, message string) {
+  v.errors = append(v.errors, FieldError{field, code, message})
+}
+
+func (v *validator) failed(field string) bool {
+  for _, fieldErr := range v.errors {
+    if field == fieldErr.Field {
+      return true
+    }
+  }
+
+  return false
+}
+
+func (v *validator) required(field, value string) {
+  if !v.failed(field) && "" == strings.TrimSpace(value) {
+    v.add(field, FieldRequired, "is required")
+  }
+}
+
+// maxLength checks value against the VARCHAR limit of its column, counted
+// in characters.
+func (v *validator) maxLength(field, value string, n int) {
+  if !v.failed(field) && n < utf8.RuneCountInString(strings.TrimSpace(value)) {
+    v.add(field, FieldTooLong, fmt.Sprintf("must have at most %d characters", n))
+  }
+}
+
+func (v *validator) email(field, value string) {
+  value = strings.TrimSpace(value)
+  if v.failed(field) || "" == value {
+    return
+  }
+
+  // A display name or comments would parse too; only a bare address is an
+  // email address here.
+  address, err := mail.ParseAddress(value)
+  if nil != err || value != address.Address {
+    v.add(field, FieldInvalidFormat, "must be an email address")
+    return
+  }
+
+  // Single label domains such as localhost parse, but cannot be mailed.
+  if !strings.Contains(value[strings.LastIndex(value, "@"):], ".") {
+    v.add(field, FieldInvalidFormat, "must be an email address")
+  }
+}
+
+// phoneNumber accepts international numbers as people write them: an
+// optional leading +, then 7 to 15 digits with spaces, dashes, dots or
+// parentheses in between.
+func (v *validator) phoneNumber(field, value string) {
+  value = strings.TrimSpace(value)
+  if v.failed(field) || "" == value {
+    return
+  }
+
+  digits := 0
+  for i, r := range value {
+    switch {
+    case '0' <= r && r <= '9':
+      digits++
+    case '+' == r && 0 == i:
+    case strings.ContainsRune(" -.()", r):
+    default:
+      v.add(field, FieldInvalidFormat, "must be a phone number")
+      return
+    }
+  }
+
+  if 7 > digits || 15 < digits {
+    v.add(field, FieldInvalidFormat, "must be a phone number")
+  }
+}
+
+func (v *validator) httpURL(field, value string) {
+  value = strings.TrimSpace(value)
+  if v.failed(field) || "" == value {
+    return
+  }
+
+  u, err := url.Parse(value)
+  if nil != err || ("http" != u.Scheme && "https" != u.Scheme) || "" == u.Host {
+    v.add(field, FieldInvalidFormat, "must be an http or https URL")
+  }
+}
+
+func (v *validator) intRange(field string, value, lower, upper int64) {
+  if !v.failed(field) && (lower > value || upper < value) {
+    v.add(field, FieldOutOfRange, fmt.Sprintf("must be between %d and %d", lower, upper))
+  }
+}
+
+func (v *validator) floatRange(field string, value, lower, upper float64) {
+  if !v.failed(field) && (lower > value || upper < value) {
+    v.add(field, FieldOutOfRange, "must be between "+strconv.FormatFloat(lower, 'f', -1, 64)+" and "+strconv.FormatFloat(upper, 'f', -1, 64))
+  }
+}
+
+func (v *validator) oneOf(field, value string, allowed []string) {
+  value = strings.ToLower(strings.TrimSpace(value))
+  if v.failed(field) || "" == value {
+    return
+  }
+
+  for _, a := range allowed {
+    if a == value {
+      return
+    }
+  }
+
+  v.add(field, FieldNotAllowed, "must be one of "+strings.Join(allowed, ", "))
+}
+
+// err returns the collected errors as a *ValidationError, or nil when
+// there are none.
+func (v *validator) err() error {
+  if 0 == len(v.errors) {
+    return nil
+  }
+
+  return &ValidationError{v.errors}
+}
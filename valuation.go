@@ -0,0 +1,356 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "math"
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+)
+
+const (
+  // valuationMinimumSample is the number of comparable listings a tier
+  // must yield before its estimate is trusted.
+  valuationMinimumSample = 5
+
+  // valuationYearlyDepreciation is the fraction of value a motorcycle
+  // loses for every year of age.
+  valuationYearlyDepreciation = 0.07
+
+  // valuationMileageDepreciation is the fraction of value a motorcycle
+  // loses for every 10 000 units of mileage.
+  valuationMileageDepreciation = 0.03
+)
+
+var ErrNoComparables = newError(ErrNotFound, "no_comparables", "no comparable listings found")
+
+type PriceRating string
+
+const (
+  PriceRatingGreat PriceRating = "great"
+  PriceRatingFair  PriceRating = "fair"
+  PriceRatingHigh  PriceRating = "high"
+)
+
+type ValuationRequest struct {
+  Brand   string `json:"brand"`
+  Model   string `json:"model"`
+  Year    int    `json:"year"`
+  Mileage int64  `json:"mileage"`
+  Type    string `json:"type"`
+}
+
+type Valuation struct {
+  Median             float64 `json:"median"`
+  Low                float64 `json:"low"`
+  High               float64 `json:"high"`
+  InterquartileRange float64 `json:"interquartile_range"`
+  SampleSize         int     `json:"sample_size"`
+  Basis              string  `json:"basis"`
+}
+
+// Rate tells how price compares to the estimated range: below the first
+// quartile is a great price, above the third quartile is a high one.
+func (v *Valuation) Rate(price float64) PriceRating {
+  switch {
+  case price < v.Low:
+    return PriceRatingGreat
+  case price <= v.High:
+    return PriceRatingFair
+  default:
+    return PriceRatingHigh
+  }
+}
+
+type comparableListing struct {
+  id      int
+  model   string
+  kind    string
+  price   float64
+  year    int
+  mileage int64
+}
+
+// valuationTier is one attempt at finding comparable listings, from the
+// most specific to the broadest.
+type valuationTier struct {
+  basis      string
+  yearWindow int
+  matchModel bool
+  matchType  bool
+}
+
+var valuationTiers = []valuationTier{
+  {basis: "brand_model_type", yearWindow: 3, matchModel: true, matchType: true},
+  {basis: "brand_model", yearWindow: 5, matchModel: true},
+  {basis: "brand_type", yearWindow: 5, matchType: true},
+  {basis: "brand", yearWindow: 10},
+}
+
+// valuationYearWindow is the year window of the broadest tier, which every
+// other tier's sample is a subset of.
+var valuationYearWindow = valuationTiers[len(valuationTiers)-1].yearWindow
+
+func (t valuationTier) matches(request *ValuationRequest, c comparableListing) bool {
+  return (!t.matchModel || strings.EqualFold(c.model, strings.TrimSpace(request.Model))) &&
+    (!t.matchType || strings.EqualFold(c.kind, strings.TrimSpace(request.Type))) &&
+    request.Year-t.yearWindow <= c.year && c.year <= request.Year+t.yearWindow
+}
+
+type ValuationService struct {
+  db *sql.DB
+}
+
+func NewValuationService(db *sql.DB) *ValuationService {
+  return &ValuationService{db}
+}
+
+// Estimate computes a price range for the described motorcycle from the
+// comparable listings in the catalogue. Listing excludeID is left out of
+// the sample so that a listing is never compared against itself.
+func (s *ValuationService) Estimate(ctx context.Context, request *ValuationRequest, excludeID int) (*Valuation, error) {
+  candidates, err := s.comparables(ctx, request.Brand, request.Year-valuationYearWindow, request.Year+valuationYearWindow)
+  if nil != err {
+    return nil, err
+  }
+
+  return estimate(request, candidates, excludeID)
+}
+
+// estimate picks the most specific tier of candidates, the listings of the
+// same brand, that yields enough comparables and derives the price range
+// from it.
+func estimate(request *ValuationRequest, candidates []comparableListing, excludeID int) (valuation *Valuation, err error) {
+  var (
+    comparables []comparableListing
+    basis       string
+  )
+
+  for _, tier := range valuationTiers {
+    if tier.matchType && "" == strings.TrimSpace(request.Type) {
+      continue
+    }
+
+    sample := make([]comparableListing, 0)
+    for _, c := range candidates {
+      if excludeID != c.id && tier.matches(request, c) {
+        sample = append(sample, c)
+      }
+    }
+
+    if len(sample) > len(comparables) {
+      comparables, basis = sample, tier.basis
+    }
+
+    if len(comparables) >= valuationMinimumSample {
+      break
+    }
+  }
+
+  if 0 == len(comparables) {
+    return nil, ErrNoComparables
+  }
+
+  prices := make([]float64, 0, len(comparables))
+  for _, c := range comparables {
+    prices = append(prices, adjustPrice(c, request.Year, request.Mileage))
+  }
+
+  sort.Float64s(prices)
+
+  valuation = &Valuation{
+    Median:     roundPrice(quantile(prices, 0.5)),
+    Low:        roundPrice(quantile(prices, 0.25)),
+    High:       roundPrice(quantile(prices, 0.75)),
+    SampleSize: len(prices),
+    Basis:      basis,
+  }
+
+  valuation.InterquartileRange = roundPrice(valuation.High - valuation.Low)
+
+  return valuation, nil
+}
+
+// Rate sets the price rating of every motorcycle whose valuation can be
+// estimated; listings without comparables are left unrated. Candidates are
+// fetched once per brand, so a page of listings costs a query per brand
+// rather than one per tier and listing.
+func (s *ValuationService) Rate(ctx context.Context, motorcycles []*Motorcycle) error {
+  type brandYears struct {
+    brand         string
+    first, latest int
+  }
+
+  brands := make(map[string]*brandYears)
+  for _, motorcycle := range motorcycles {
+    key := strings.ToLower(strings.TrimSpace(motorcycle.Brand))
+
+    years, ok := brands[key]
+    if !ok {
+      brands[key] = &brandYears{motorcycle.Brand, motorcycle.Year, motorcycle.Year}
+      continue
+    }
+
+    years.first, years.latest = min(years.first, motorcycle.Year), max(years.latest, motorcycle.Year)
+  }
+
+  candidates := make(map[string][]comparableListing, len(brands))
+  for key, years := range brands {
+    sample, err := s.comparables(ctx, years.brand, years.first-valuationYearWindow, years.latest+valuationYearWindow)
+    if nil != err {
+      return err
+    }
+
+    candidates[key] = sample
+  }
+
+  for _, motorcycle := range motorcycles {
+    request := &ValuationRequest{
+      Brand:   motorcycle.Brand,
+      Model:   motorcycle.Model,
+      Year:    motorcycle.Year,
+      Mileage: motorcycle.Mileage,
+      Type:    motorcycle.Type,
+    }
+
+    valuation, err := estimate(request, candidates[strings.ToLower(strings.TrimSpace(motorcycle.Brand))], motorcycle.ID)
+    if nil != err {
+      if errors.Is(err, ErrNoComparables) {
+        continue
+      }
+
+      return err
+    }
+
+    motorcycle.PriceRating = valuation.Rate(float64(motorcycle.Price))
+  }
+
+  return nil
+}
+
+// comparables returns the active listings of brand built between the
+// years from and to, which the tiers then narrow down.
+func (s *ValuationService) comparables(ctx context.Context, brand string, from, to int) (comparables []comparableListing, err error) {
+  getComparablesQuery := `
+  SELECT id,
+         model,
+         type,
+         price,
+         year,
+         mileage
+    FROM motorcycle
+   WHERE deleted_at IS NULL
+     AND status = 'active'
+     AND price > 0
+     AND lower(brand) = lower(@brand)
+     AND year BETWEEN @from AND @to;`
+
+  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+  defer cancel()
+
+  result, err := s.db.QueryContext(ctx, getComparablesQuery,
+    sql.Named("brand", strings.TrimSpace(brand)),
+    sql.Named("from", from),
+    sql.Named("to", to))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  for result.Next() {
+    var c comparableListing
+
+    err = result.Scan(&c.id, &c.model, &c.kind, &c.price, &c.year, &c.mileage)
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    comparables = append(comparables, c)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return comparables, nil
+}
+
+// adjustPrice brings the asking price of a comparable listing in line with
+// the year and mileage of the motorcycle being valued.
+func adjustPrice(c comparableListing, year int, mileage int64) float64 {
+  yearFactor := math.Pow(1+valuationYearlyDepreciation, float64(year-c.year))
+
+  mileageFactor := 1 - valuationMileageDepreciation*float64(mileage-c.mileage)/10_000
+  mileageFactor = max(0.5, min(1.5, mileageFactor))
+
+  return c.price * yearFactor * mileageFactor
+}
+
+// quantile returns the q-th quantile of sorted using linear interpolation
+// between the closest ranks.
+func quantile(sorted []float64, q float64) float64 {
+  if 0 == len(sorted) {
+    return 0
+  }
+
+  position := q * float64(len(sorted)-1)
+  lower := int(math.Floor(position))
+  upper := int(math.Ceil(position))
+
+  return sorted[lower] + (sorted[upper]-sorted[lower])*(position-float64(lower))
+}
+
+func roundPrice(price float64) float64 {
+  return math.Round(price*100) / 100
+}
+
+type ValuationHandler struct {
+  s *ValuationService
+}
+
+func NewValuationHandler(service *ValuationService) *ValuationHandler {
+  return &ValuationHandler{service}
+}
+
+func (h *ValuationHandler) Create(w http.ResponseWriter, r *http.Request) {
+  request := ValuationRequest{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&request)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  if "" == strings.TrimSpace(request.Brand) || "" == strings.TrimSpace(request.Model) || 0 >= request.Year || 0 > request.Mileage {
+    writeError(w, r, fmt.Errorf("%w: brand, model, year and mileage are required", ErrInvalidInput))
+    return
+  }
+
+  valuation, err := h.s.Estimate(r.Context(), &request, 0)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(valuation)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "crypto/subtle"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "math"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+type EmailVerification struct {
+  Token string `json:"token"`
+}
+
+var (
+  ErrInvalidVerificationToken = newError(ErrInvalidInput, "invalid_verification_token", "invalid verification token")
+  ErrVerificationTokenExpired = newError(ErrGone, "verification_token_expired", "verification token expired")
+  ErrEmailAlreadyVerified     = newError(ErrConflict, "email_already_verified", "email already verified")
+  ErrEmailNotVerified         = newError(ErrForbidden, "email_not_verified", "email not verified")
+)
+
+// VerificationRateLimitedError is returned when a new verification email is
+// asked for too soon after the previous one.
+type VerificationRateLimitedError struct {
+  RetryAfter time.Duration
+}
+
+func (e *VerificationRateLimitedError) Error() string {
+  return fmt.Sprintf("verification email sent recently, retry after %s", e.RetryAfter)
+}
+
+func (e *VerificationRateLimitedError) code() string {
+  return "verification_rate_limited"
+}
+
+func (e *VerificationRateLimitedError) retryAfter() time.Duration {
+  return e.RetryAfter
+}
+
+// emailVerificationSecret signs verification tokens. EMAIL_VERIFICATION_SECRET
+// has to be set; links sent while it fell back to JWT_SECRET keep working by
+// setting it to that value.
+func emailVerificationSecret() ([]byte, error) {
+  secret := os.Getenv("EMAIL_VERIFICATION_SECRET")
+  if "" == secret {
+    return nil, errors.New("EMAIL_VERIFICATION_SECRET is not set")
+  }
+
+  return []byte(secret), nil
+}
+
+// EmailVerificationPolicy configures how addresses are verified.
+type EmailVerificationPolicy struct {
+  // TTL is how long a verification link stays valid.
+  TTL time.Duration
+
+  // ResendInterval is the minimum time between two verification emails to
+  // the same user.
+  ResendInterval time.Duration
+
+  // RequiredToPublish blocks publishing listings until the address is
+  // verified.
+  RequiredToPublish bool
+
+  // URL is the link the token is appended to in the email.
+  URL string
+}
+
+func emailVerificationPolicyFromEnv() EmailVerificationPolicy {
+  policy := EmailVerificationPolicy{
+    TTL:            envDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour),
+    ResendInterval: envDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute),
+    URL:            os.Getenv("EMAIL_VERIFICATION_URL"),
+  }
+
+  if "" == policy.URL {
+    policy.URL = "motonica://verify-email"
+  }
+
+  if value := os.Getenv("REQUIRE_VERIFIED_EMAIL_TO_PUBLISH"); "" != value {
+    required, err := strconv.ParseBool(value)
+    if nil != err {
+      slog.Error("invalid boolean in REQUIRE_VERIFIED_EMAIL_TO_PUBLISH: " + err.Error())
+    }
+
+    policy.RequiredToPublish = required
+  }
+
+  return policy
+}
+
+type EmailVerificationService struct {
+  db     *sql.DB
+  audit  *AuditService
+  emails *EmailService
+  secret []byte
+  policy EmailVerificationPolicy
+}
+
+func NewEmailVerificationService(db *sql.DB, audit *AuditService, emails *EmailService, secret []byte, policy EmailVerificationPolicy) *EmailVerificationService {
+  return &EmailVerificationService{db, audit, emails, secret, policy}
+}
+
+// sign returns the signature of a verification token payload.
+func (s *EmailVerificationService) sign(payload string) string {
+  mac := hmac.New(sha256.New, s.secret)
+  mac.Write([]byte(payload))
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send emails a verification link for the current address of userID as part
+// of tx. Tokens have the form <id>.<random>.<signature>; only the digest of
+// the random part is stored.
+func (s *EmailVerificationService) Send(ctx context.Context, tx *sql.Tx, userID int) error {
+  getUserQuery := `
+  SELECT email, first_name, locale
+    FROM "user"
+   WHERE id = $1;`
+
+  createVerificationQuery := `
+  INSERT INTO email_verification (user_id, email, token_hash, expires_at)
+                          VALUES (@user_id, @email, @token_hash, @expires_at)
+    RETURNING id;`
+
+  var (
+    email, firstName, locale string
+    id                       int
+  )
+
+  err := tx.QueryRowContext(ctx, getUserQuery, userID).Scan(&email, &firstName, &locale)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  secret := randomHex(32)
+
+  err = tx.QueryRowContext(ctx, createVerificationQuery,
+    sql.Named("user_id", userID),
+    sql.Named("email", email),
+    sql.Named("token_hash", hashToken(secret)),
+    sql.Named("expires_at", time.Now().UTC().Add(s.policy.TTL).Format(time.DateTime))).
+    Scan(&id)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  payload := strconv.Itoa(id) + "." + secret
+  token := payload + "." + s.sign(payload)
+
+  return s.emails.Enqueue(ctx, tx, email, "verify_email", locale, map[string]any{
+    "first_name": firstName,
+    "url":        s.policy.URL + "?token=" + url.QueryEscape(token),
+    "expires_in": int(math.Round(s.policy.TTL.Hours())),
+  })
+}
+
+// Verify consumes a verification token and marks the address it was sent to
+// as verified, provided the user still has that address.
+func (s *EmailVerificationService) Verify(ctx context.Context, token string) error {
+  parts := strings.Split(token, ".")
+  if 3 != len(parts) {
+    return ErrInvalidVerificationToken
+  }
+
+  payload := parts[0] + "." + parts[1]
+  if !hmac.Equal([]byte(parts[2]), []byte(s.sign(payload))) {
+    return ErrInvalidVerificationToken
+  }
+
+  id, err := strconv.Atoi(parts[0])
+  if nil != err {
+    return ErrInvalidVerificationToken
+  }
+
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  getVerificationQuery := `
+  SELECT user_id, email, token_hash, expires_at
+    FROM email_verification
+   WHERE id = $1
+     AND used_at IS NULL;`
+
+  verifyEmailQuery := `
+  UPDATE "user"
+     SET email_verified_at = current_timestamp,
+         updated_at = current_timestamp
+   WHERE id = @user_id
+     AND email = @email
+     AND deleted_at IS NULL;`
+
+  useVerificationsQuery := `
+  UPDATE email_verification
+     SET used_at = current_timestamp
+   WHERE user_id = $1
+     AND used_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    userID               int
+    email, hash, expires string
+  )
+
+  err = tx.QueryRowContext(ctx, getVerificationQuery, id).Scan(&userID, &email, &hash, &expires)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrInvalidVerificationToken
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  if 1 != subtle.ConstantTimeCompare([]byte(hash), []byte(hashToken(parts[1]))) {
+    return ErrInvalidVerificationToken
+  }
+
+  if expires < time.Now().UTC().Format(time.DateTime) {
+    return ErrVerificationTokenExpired
+  }
+
+  before, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrInvalidVerificationToken
+    }
+
+    return err
+  }
+
+  result, err := tx.ExecContext(ctx, verifyEmailQuery, sql.Named("user_id", userID), sql.Named("email", email))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  // The address changed since the link was sent, so it proves nothing.
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return ErrInvalidVerificationToken
+  }
+
+  after, err := snapshot(ctx, tx, userSnapshotQuery, sql.Named("id", userID))
+  if nil != err {
+    return err
+  }
+
+  err = s.audit.Record(ctx, tx, AuditActionUpdate, "user", userID, before, after)
+  if nil != err {
+    return err
+  }
+
+  _, err = tx.ExecContext(ctx, useVerificationsQuery, userID)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Resend emails a new verification link unless the address is already
+// verified or the previous link was sent too recently.
+func (s *EmailVerificationService) Resend(ctx context.Context, userID int) error {
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  getVerificationStateQuery := `
+  SELECT u.email_verified_at IS NOT NULL,
+         (SELECT max(v.created_at)
+            FROM email_verification v
+           WHERE v.user_id = u.id)
+    FROM "user" u
+   WHERE u.id = $1
+     AND u.deleted_at IS NULL;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  var (
+    verified bool
+    lastSent sql.NullString
+  )
+
+  err = tx.QueryRowContext(ctx, getVerificationStateQuery, userID).Scan(&verified, &lastSent)
+  if nil != err {
+    if errors.Is(err, sql.ErrNoRows) {
+      return ErrUserNotFound
+    }
+
+    slog.Error(err.Error())
+    return err
+  }
+
+  if verified {
+    return ErrEmailAlreadyVerified
+  }
+
+  if lastSent.Valid {
+    sentAt, err := time.Parse(time.DateTime, lastSent.String)
+    if nil != err {
+      slog.Error(err.Error())
+      return err
+    }
+
+    if wait := time.Until(sentAt.Add(s.policy.ResendInterval)); 0 < wait {
+      return &VerificationRateLimitedError{RetryAfter: wait}
+    }
+  }
+
+  if err = s.Send(ctx, tx, userID); nil != err {
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// RequireVerified fails with ErrEmailNotVerified when the policy asks for a
+// verified address to publish listings and userID does not have one.
+func (s *EmailVerificationService) RequireVerified(ctx context.Context, q querier, userID int) error {
+  if !s.policy.RequiredToPublish {
+    return nil
+  }
+
+  getVerifiedQuery := `
+  SELECT email_verified_at IS NOT NULL
+    FROM "user"
+   WHERE id = $1;`
+
+  var verified bool
+
+  err := q.QueryRowContext(ctx, getVerifiedQuery, userID).Scan(&verified)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if !verified {
+    return ErrEmailNotVerified
+  }
+
+  return nil
+}
+
+type EmailVerificationHandler struct {
+  s *EmailVerificationService
+}
+
+func NewEmailVerificationHandler(service *EmailVerificationService) *EmailVerificationHandler {
+  return &EmailVerificationHandler{service}
+}
+
+func (h *EmailVerificationHandler) Verify(w http.ResponseWriter, r *http.Request) {
+  verification := EmailVerification{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&verification)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  err = h.s.Verify(r.Context(), verification.Token)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *EmailVerificationHandler) Resend(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  err := h.s.Resend(r.Context(), userID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusAccepted)
+}
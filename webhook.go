@@ -0,0 +1,736 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+const (
+  EventMotorcycleCreated  = "motorcycle.created"
+  EventMotorcycleUpdated  = "motorcycle.updated"
+  EventMotorcycleSold     = "motorcycle.sold"
+  EventMotorcycleDeleted  = "motorcycle.deleted"
+  EventMotorcycleRestored = "motorcycle.restored"
+  EventMotorcycleExpired  = "motorcycle.expired"
+  EventFavoriteAdded      = "favorite.added"
+  EventUserUpdated        = "user.updated"
+  EventUserDeleted        = "user.deleted"
+)
+
+var webhookEventTypes = map[string]bool{
+  EventMotorcycleCreated:  true,
+  EventMotorcycleUpdated:  true,
+  EventMotorcycleSold:     true,
+  EventMotorcycleDeleted:  true,
+  EventMotorcycleRestored: true,
+  EventMotorcycleExpired:  true,
+  EventFavoriteAdded:      true,
+  EventUserUpdated:        true,
+  EventUserDeleted:        true,
+}
+
+const (
+  WebhookDeliveryPending   = "pending"
+  WebhookDeliveryDelivered = "delivered"
+  WebhookDeliveryDead      = "dead"
+)
+
+const (
+  // webhookMaxAttempts is how many times a delivery is tried before it is
+  // moved to the dead-letter state.
+  webhookMaxAttempts = 10
+
+  webhookBaseBackoff = 30 * time.Second
+  webhookMaxBackoff  = 6 * time.Hour
+
+  // webhookBatchSize bounds the deliveries sent on every worker run.
+  webhookBatchSize = 20
+)
+
+var (
+  ErrWebhookNotFound         = newError(ErrNotFound, "webhook_not_found", "webhook not found")
+  ErrWebhookDeliveryNotFound = newError(ErrNotFound, "webhook_delivery_not_found", "webhook delivery not found")
+  ErrInvalidWebhook          = newError(ErrInvalidInput, "invalid_webhook", "invalid webhook")
+)
+
+type WebhookSubscription struct {
+  ID         int      `json:"id"`
+  URL        string   `json:"url"`
+  Secret     string   `json:"secret,omitempty"`
+  EventTypes []string `json:"event_types"`
+  CreatedAt  string   `json:"created_at"`
+}
+
+type WebhookSubscriptionCreation struct {
+  URL        string   `json:"url"`
+  Secret     string   `json:"secret"`
+  EventTypes []string `json:"event_types"`
+}
+
+type WebhookDelivery struct {
+  ID             int     `json:"id"`
+  EventID        string  `json:"event_id"`
+  EventType      string  `json:"event_type"`
+  Status         string  `json:"status"`
+  Attempts       int     `json:"attempts"`
+  NextAttemptAt  string  `json:"next_attempt_at"`
+  LastStatusCode *int    `json:"last_status_code"`
+  LastError      *string `json:"last_error"`
+  CreatedAt      string  `json:"created_at"`
+  DeliveredAt    *string `json:"delivered_at"`
+}
+
+type WebhookEvent struct {
+  ID        string `json:"id"`
+  Type      string `json:"type"`
+  CreatedAt string `json:"created_at"`
+  Data      any    `json:"data"`
+}
+
+// isPublicIP tells whether ip is routable on the internet, as opposed to
+// loopback, private, carrier-grade NAT, link-local (cloud metadata services
+// live there) and other special ranges.
+func isPublicIP(ip net.IP) bool {
+  // net.IP has no predicate for "this" network, 0.0.0.0/8, nor for
+  // carrier-grade NAT, 100.64.0.0/10.
+  if ip4 := ip.To4(); nil != ip4 && (0 == ip4[0] || (100 == ip4[0] && 64 == ip4[1]&0xc0)) {
+    return false
+  }
+
+  return nil != ip && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+    !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// publicHTTPClient only connects to public addresses, so that the URLs
+// users store cannot be used to read internal services. Addresses are
+// checked once resolved, which covers redirects too.
+func publicHTTPClient(timeout time.Duration) *http.Client {
+  dialer := &net.Dialer{
+    Timeout: 10 * time.Second,
+    Control: func(network, address string, _ syscall.RawConn) error {
+      host, _, err := net.SplitHostPort(address)
+      if nil != err {
+        return err
+      }
+
+      if !isPublicIP(net.ParseIP(host)) {
+        return fmt.Errorf("refusing to connect to non-public address %s", host)
+      }
+
+      return nil
+    },
+  }
+
+  return &http.Client{
+    Timeout:   timeout,
+    Transport: &http.Transport{DialContext: dialer.DialContext},
+  }
+}
+
+// signWebhook computes the value of the X-Webhook-Signature header: an
+// HMAC-SHA256 of the timestamp and the body, keyed with the secret.
+func signWebhook(secret, timestamp string, body []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write([]byte(timestamp))
+  mac.Write([]byte("."))
+  mac.Write(body)
+
+  return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookService struct {
+  db     *sql.DB
+  client *http.Client
+}
+
+func NewWebhookService(db *sql.DB, client *http.Client) *WebhookService {
+  return &WebhookService{db, client}
+}
+
+func (s *WebhookService) Create(ctx context.Context, userID int, creation *WebhookSubscriptionCreation) (subscription *WebhookSubscription, err error) {
+  endpoint, err := url.Parse(strings.TrimSpace(creation.URL))
+  if nil != err || ("http" != endpoint.Scheme && "https" != endpoint.Scheme) || "" == endpoint.Hostname() {
+    return nil, ErrInvalidWebhook
+  }
+
+  // Names are only resolved when delivering, where the client refuses
+  // non-public addresses; what can be told now is refused upfront.
+  host := strings.ToLower(strings.TrimSuffix(endpoint.Hostname(), "."))
+  if ip := net.ParseIP(host); (nil != ip && !isPublicIP(ip)) || "localhost" == host || strings.HasSuffix(host, ".localhost") {
+    return nil, ErrInvalidWebhook
+  }
+
+  if 0 == len(creation.EventTypes) {
+    return nil, ErrInvalidWebhook
+  }
+
+  for _, eventType := range creation.EventTypes {
+    if !webhookEventTypes[eventType] {
+      return nil, ErrInvalidWebhook
+    }
+  }
+
+  secret := strings.TrimSpace(creation.Secret)
+  if "" == secret {
+    secret = randomHex(32)
+  }
+
+  createSubscriptionQuery := `
+  INSERT INTO webhook_subscription (user_id, url, secret, event_types)
+                            VALUES (@user_id, @url, @secret, @event_types)
+    RETURNING id, created_at;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  subscription = &WebhookSubscription{
+    URL:        endpoint.String(),
+    Secret:     secret,
+    EventTypes: creation.EventTypes,
+  }
+
+  err = s.db.QueryRowContext(ctx, createSubscriptionQuery,
+    sql.Named("user_id", userID),
+    sql.Named("url", subscription.URL),
+    sql.Named("secret", secret),
+    sql.Named("event_types", strings.Join(creation.EventTypes, ","))).
+    Scan(&subscription.ID, &subscription.CreatedAt)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return subscription, nil
+}
+
+func (s *WebhookService) Get(ctx context.Context, userID int) (subscriptions []*WebhookSubscription, err error) {
+  getSubscriptionsQuery := `
+  SELECT id, url, event_types, created_at
+    FROM webhook_subscription
+   WHERE user_id = $1
+ORDER BY id;`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  result, err := s.db.QueryContext(ctx, getSubscriptionsQuery, userID)
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  subscriptions = make([]*WebhookSubscription, 0)
+
+  for result.Next() {
+    var (
+      subscription WebhookSubscription
+      eventTypes   string
+    )
+
+    err = result.Scan(&subscription.ID, &subscription.URL, &eventTypes, &subscription.CreatedAt)
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    subscription.EventTypes = strings.Split(eventTypes, ",")
+    subscriptions = append(subscriptions, &subscription)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return subscriptions, nil
+}
+
+func (s *WebhookService) Delete(ctx context.Context, userID, id int) error {
+  deleteSubscriptionQuery := `
+  DELETE
+    FROM webhook_subscription
+   WHERE id = @id
+     AND user_id = @user_id;`
+
+  deleteDeliveriesQuery := `
+  DELETE
+    FROM webhook_delivery
+   WHERE subscription_id = @id;`
+
+  tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  defer tx.Rollback()
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  result, err := tx.ExecContext(ctx, deleteSubscriptionQuery, sql.Named("id", id), sql.Named("user_id", userID))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return ErrWebhookNotFound
+  }
+
+  _, err = tx.ExecContext(ctx, deleteDeliveriesQuery, sql.Named("id", id))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if err = tx.Commit(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+// Enqueue queues a delivery of the event for every subscription of userID
+// listening to eventType. It runs in tx so that an event is only ever sent
+// for a change that was committed.
+func (s *WebhookService) Enqueue(ctx context.Context, tx *sql.Tx, userID int, eventType string, data map[string]any) error {
+  enqueueQuery := `
+  INSERT INTO webhook_delivery (subscription_id, event_id, event_type, payload)
+       SELECT id, @event_id, @event_type, @payload
+         FROM webhook_subscription
+        WHERE user_id = @user_id
+          AND instr(',' || event_types || ',', ',' || @event_type || ',') > 0;`
+
+  redacted := make(map[string]any, len(data))
+  for field, value := range data {
+    if !auditRedactedFields[field] {
+      redacted[field] = value
+    }
+  }
+
+  event := &WebhookEvent{
+    ID:        randomHex(16),
+    Type:      eventType,
+    CreatedAt: time.Now().UTC().Format(time.RFC3339),
+    Data:      redacted,
+  }
+
+  payload, err := json.Marshal(event)
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  _, err = tx.ExecContext(ctx, enqueueQuery,
+    sql.Named("event_id", event.ID),
+    sql.Named("event_type", eventType),
+    sql.Named("payload", string(payload)),
+    sql.Named("user_id", userID))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+func (s *WebhookService) GetDeliveries(ctx context.Context, userID, subscriptionID, page int) (deliveries []*WebhookDelivery, err error) {
+  getDeliveriesQuery := `
+  SELECT d.id,
+         d.event_id,
+         d.event_type,
+         d.status,
+         d.attempts,
+         d.next_attempt_at,
+         d.last_status_code,
+         d.last_error,
+         d.created_at,
+         d.delivered_at
+    FROM webhook_delivery d
+    JOIN webhook_subscription s
+      ON s.id = d.subscription_id
+   WHERE s.id = @subscription_id
+     AND s.user_id = @user_id
+ORDER BY d.id DESC
+   LIMIT 20
+   OFFSET 20 * (@page - 1);`
+
+  ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+  defer cancel()
+
+  if 0 >= page {
+    page = 1
+  }
+
+  result, err := s.db.QueryContext(ctx, getDeliveriesQuery,
+    sql.Named("subscription_id", subscriptionID),
+    sql.Named("user_id", userID),
+    sql.Named("page", page))
+  if nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  defer result.Close()
+
+  deliveries = make([]*WebhookDelivery, 0)
+
+  for result.Next() {
+    var delivery WebhookDelivery
+
+    err = result.Scan(
+      &delivery.ID,
+      &delivery.EventID,
+      &delivery.EventType,
+      &delivery.Status,
+      &delivery.Attempts,
+      &delivery.NextAttemptAt,
+      &delivery.LastStatusCode,
+      &delivery.LastError,
+      &delivery.CreatedAt,
+      &delivery.DeliveredAt,
+    )
+
+    if nil != err {
+      slog.Error(err.Error())
+      return nil, err
+    }
+
+    deliveries = append(deliveries, &delivery)
+  }
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return nil, err
+  }
+
+  return deliveries, nil
+}
+
+// Redeliver puts a delivery back in the queue with a fresh attempt budget,
+// whatever its current state.
+func (s *WebhookService) Redeliver(ctx context.Context, userID, subscriptionID, deliveryID int) error {
+  redeliverQuery := `
+  UPDATE webhook_delivery
+     SET status = 'pending',
+         attempts = 0,
+         next_attempt_at = current_timestamp
+   WHERE id = @delivery_id
+     AND subscription_id IN (SELECT id
+                               FROM webhook_subscription
+                              WHERE id = @subscription_id
+                                AND user_id = @user_id);`
+
+  ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+  defer cancel()
+
+  result, err := s.db.ExecContext(ctx, redeliverQuery,
+    sql.Named("delivery_id", deliveryID),
+    sql.Named("subscription_id", subscriptionID),
+    sql.Named("user_id", userID))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  if affected, _ := result.RowsAffected(); 1 != affected {
+    return ErrWebhookDeliveryNotFound
+  }
+
+  return nil
+}
+
+type dueWebhookDelivery struct {
+  id        int
+  eventID   string
+  eventType string
+  payload   string
+  attempts  int
+  url       string
+  secret    string
+}
+
+// Deliver sends the deliveries that are due, rescheduling failures with
+// exponential backoff until they run out of attempts.
+func (s *WebhookService) Deliver(ctx context.Context) error {
+  getDueDeliveriesQuery := `
+  SELECT d.id, d.event_id, d.event_type, d.payload, d.attempts, s.url, s.secret
+    FROM webhook_delivery d
+    JOIN webhook_subscription s
+      ON s.id = d.subscription_id
+   WHERE d.status = 'pending'
+     AND d.next_attempt_at <= @now
+ORDER BY d.next_attempt_at
+   LIMIT @limit;`
+
+  result, err := s.db.QueryContext(ctx, getDueDeliveriesQuery,
+    sql.Named("now", time.Now().UTC().Format(time.DateTime)),
+    sql.Named("limit", webhookBatchSize))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  due := make([]*dueWebhookDelivery, 0)
+
+  for result.Next() {
+    var delivery dueWebhookDelivery
+
+    err = result.Scan(&delivery.id, &delivery.eventID, &delivery.eventType, &delivery.payload, &delivery.attempts, &delivery.url, &delivery.secret)
+    if nil != err {
+      result.Close()
+      slog.Error(err.Error())
+      return err
+    }
+
+    due = append(due, &delivery)
+  }
+
+  result.Close()
+
+  if err = result.Err(); nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  for _, delivery := range due {
+    statusCode, err := s.send(ctx, delivery)
+    if err = s.recordAttempt(ctx, delivery, statusCode, err); nil != err {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (s *WebhookService) send(ctx context.Context, delivery *dueWebhookDelivery) (statusCode int, err error) {
+  body := []byte(delivery.payload)
+  timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+  request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(body))
+  if nil != err {
+    return 0, err
+  }
+
+  request.Header.Set("Content-Type", "application/json")
+  request.Header.Set("User-Agent", "motonica-webhooks/1")
+  request.Header.Set("X-Webhook-Event", delivery.eventType)
+  request.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.id))
+  request.Header.Set("X-Webhook-Event-ID", delivery.eventID)
+  request.Header.Set("X-Webhook-Timestamp", timestamp)
+  request.Header.Set("X-Webhook-Signature", signWebhook(delivery.secret, timestamp, body))
+
+  response, err := s.client.Do(request)
+  if nil != err {
+    return 0, err
+  }
+
+  defer response.Body.Close()
+  io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+  if 200 > response.StatusCode || 300 <= response.StatusCode {
+    return response.StatusCode, fmt.Errorf("unexpected status %d", response.StatusCode)
+  }
+
+  return response.StatusCode, nil
+}
+
+func (s *WebhookService) recordAttempt(ctx context.Context, delivery *dueWebhookDelivery, statusCode int, sendErr error) error {
+  recordAttemptQuery := `
+  UPDATE webhook_delivery
+     SET status = @status,
+         attempts = attempts + 1,
+         next_attempt_at = @next_attempt_at,
+         last_status_code = @last_status_code,
+         last_error = @last_error,
+         delivered_at = CASE WHEN 'delivered' = @status THEN current_timestamp END
+   WHERE id = @id;`
+
+  var (
+    attempts       = delivery.attempts + 1
+    status         = WebhookDeliveryDelivered
+    nextAttemptAt  = time.Now().UTC()
+    lastStatusCode any
+    lastError      any
+  )
+
+  if 0 != statusCode {
+    lastStatusCode = statusCode
+  }
+
+  if nil != sendErr {
+    lastError = sendErr.Error()
+    status = WebhookDeliveryPending
+    nextAttemptAt = nextAttemptAt.Add(exponentialBackoff(webhookBaseBackoff, webhookMaxBackoff, attempts))
+
+    if webhookMaxAttempts <= attempts {
+      status = WebhookDeliveryDead
+    }
+  }
+
+  _, err := s.db.ExecContext(ctx, recordAttemptQuery,
+    sql.Named("id", delivery.id),
+    sql.Named("status", status),
+    sql.Named("next_attempt_at", nextAttemptAt.Format(time.DateTime)),
+    sql.Named("last_status_code", lastStatusCode),
+    sql.Named("last_error", lastError))
+  if nil != err {
+    slog.Error(err.Error())
+    return err
+  }
+
+  return nil
+}
+
+type WebhookHandler struct {
+  s *WebhookService
+}
+
+func NewWebhookHandler(service *WebhookService) *WebhookHandler {
+  return &WebhookHandler{service}
+}
+
+func (h *WebhookHandler) Create(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+  creation := WebhookSubscriptionCreation{}
+
+  decoder := json.NewDecoder(r.Body)
+  err := decoder.Decode(&creation)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrMalformedBody)
+    return
+  }
+
+  subscription, err := h.s.Create(r.Context(), userID, &creation)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(subscription)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusCreated)
+  w.Write(response)
+}
+
+func (h *WebhookHandler) Get(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  subscriptions, err := h.s.Get(r.Context(), userID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(subscriptions)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *WebhookHandler) Delete(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  webhookID, err := strconv.Atoi(r.PathValue("webhook_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  err = h.s.Delete(r.Context(), userID, webhookID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *WebhookHandler) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  webhookID, err := strconv.Atoi(r.PathValue("webhook_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  page, err := strconv.Atoi(r.URL.Query().Get("page"))
+  if nil != err {
+    page = 1
+  }
+
+  deliveries, err := h.s.GetDeliveries(r.Context(), userID, webhookID, page)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  response, err := json.Marshal(deliveries)
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusOK)
+  w.Write(response)
+}
+
+func (h *WebhookHandler) Redeliver(w http.ResponseWriter, r *http.Request) {
+  userID := principalFrom(r.Context()).UserID
+
+  webhookID, err := strconv.Atoi(r.PathValue("webhook_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  deliveryID, err := strconv.Atoi(r.PathValue("delivery_id"))
+  if nil != err {
+    slog.Error(err.Error())
+    writeError(w, r, ErrInvalidID)
+    return
+  }
+
+  err = h.s.Redeliver(r.Context(), userID, webhookID, deliveryID)
+  if nil != err {
+    writeError(w, r, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+const testWebhookSecret = "test-webhook-secret"
+
+// newWebhookTest opens a fresh database from database.sql holding one user
+// subscribed to url, and queues a single motorcycle.created delivery.
+func newWebhookTest(t *testing.T, url string) (*WebhookService, *sql.DB) {
+  t.Helper()
+
+  schema, err := os.ReadFile("database.sql")
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "db.sqlite"))
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  t.Cleanup(func() { db.Close() })
+
+  if _, err = db.Exec(string(schema)); nil != err {
+    t.Fatal(err)
+  }
+
+  _, err = db.Exec(`
+  INSERT INTO user (id, first_name, email, phone_number, password)
+       VALUES (1, 'Test', 'test@example.com', '+10000000000', 'x');`)
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  // Create refuses loopback URLs, which is all httptest can listen on.
+  _, err = db.Exec(`
+  INSERT INTO webhook_subscription (id, user_id, url, secret, event_types)
+       VALUES (1, 1, @url, @secret, @event_types);`,
+    sql.Named("url", url),
+    sql.Named("secret", testWebhookSecret),
+    sql.Named("event_types", EventMotorcycleCreated))
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  service := NewWebhookService(db, &http.Client{Timeout: 5 * time.Second})
+
+  tx, err := db.Begin()
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  err = service.Enqueue(context.Background(), tx, 1, EventMotorcycleCreated, map[string]any{"id": 7, "password": "secret"})
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  if err = tx.Commit(); nil != err {
+    t.Fatal(err)
+  }
+
+  return service, db
+}
+
+type testWebhookDelivery struct {
+  status        string
+  attempts      int
+  nextAttemptAt time.Time
+  lastCode      sql.NullInt64
+  deliveredAt   sql.NullString
+}
+
+func getTestWebhookDelivery(t *testing.T, db *sql.DB) testWebhookDelivery {
+  t.Helper()
+
+  var (
+    delivery      testWebhookDelivery
+    nextAttemptAt string
+  )
+
+  err := db.QueryRow(`
+  SELECT status, attempts, next_attempt_at, last_status_code, delivered_at
+    FROM webhook_delivery
+   WHERE id = 1;`).Scan(&delivery.status, &delivery.attempts, &nextAttemptAt, &delivery.lastCode, &delivery.deliveredAt)
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  delivery.nextAttemptAt, err = time.Parse(time.DateTime, nextAttemptAt)
+  if nil != err {
+    t.Fatal(err)
+  }
+
+  return delivery
+}
+
+func TestWebhookDeliverSigned(t *testing.T) {
+  var received atomic.Int32
+
+  receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    body, _ := io.ReadAll(r.Body)
+    timestamp := r.Header.Get("X-Webhook-Timestamp")
+
+    if signWebhook(testWebhookSecret, timestamp, body) != r.Header.Get("X-Webhook-Signature") {
+      t.Errorf("signature %q does not match the body", r.Header.Get("X-Webhook-Signature"))
+    }
+
+    if EventMotorcycleCreated != r.Header.Get("X-Webhook-Event") {
+      t.Errorf("X-Webhook-Event = %q, want %q", r.Header.Get("X-Webhook-Event"), EventMotorcycleCreated)
+    }
+
+    if "" == r.Header.Get("X-Webhook-Event-ID") || "1" != r.Header.Get("X-Webhook-Delivery") {
+      t.Errorf("missing delivery headers: %v", r.Header)
+    }
+
+    if strings.Contains(string(body), "password") {
+      t.Errorf("payload leaks a redacted field: %s", body)
+    }
+
+    received.Add(1)
+    w.WriteHeader(http.StatusNoContent)
+  }))
+
+  defer receiver.Close()
+
+  service, db := newWebhookTest(t, receiver.URL)
+
+  if err := service.Deliver(context.Background()); nil != err {
+    t.Fatal(err)
+  }
+
+  if 1 != received.Load() {
+    t.Fatalf("receiver got %d requests, want 1", received.Load())
+  }
+
+  delivery := getTestWebhookDelivery(t, db)
+  if WebhookDeliveryDelivered != delivery.status || 1 != delivery.attempts || !delivery.deliveredAt.Valid {
+    t.Fatalf("delivery = %+v, want delivered after 1 attempt", delivery)
+  }
+
+  // A delivered event is not sent again.
+  if err := service.Deliver(context.Background()); nil != err {
+    t.Fatal(err)
+  }
+
+  if 1 != received.Load() {
+    t.Fatalf("receiver got %d requests, want 1", received.Load())
+  }
+}
+
+func TestWebhookDeliverBackoff(t *testing.T) {
+  var received atomic.Int32
+
+  receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    received.Add(1)
+    w.WriteHeader(http.StatusInternalServerError)
+  }))
+
+  defer receiver.Close()
+
+  service, db := newWebhookTest(t, receiver.URL)
+
+  before := time.Now().UTC().Truncate(time.Second)
+
+  if err := service.Deliver(context.Background()); nil != err {
+    t.Fatal(err)
+  }
+
+  delivery := getTestWebhookDelivery(t, db)
+  if WebhookDeliveryPending != delivery.status || 1 != delivery.attempts || http.StatusInternalServerError != delivery.lastCode.Int64 {
+    t.Fatalf("delivery = %+v, want pending after 1 failed attempt", delivery)
+  }
+
+  if wait := delivery.nextAttemptAt.Sub(before); webhookBaseBackoff > wait || webhookBaseBackoff+5*time.Second < wait {
+    t.Fatalf("retry scheduled in %s, want about %s", wait, webhookBaseBackoff)
+  }
+
+  // The retry is not due yet.
+  if err := service.Deliver(context.Background()); nil != err {
+    t.Fatal(err)
+  }
+
+  if 1 != received.Load() {
+    t.Fatalf("receiver got %d requests, want 1", received.Load())
+  }
+
+  // The backoff doubles on every failure until it reaches the ceiling.
+  for attempts, want := range map[int]time.Duration{
+    1:  webhookBaseBackoff,
+    2:  2 * webhookBaseBackoff,
+    3:  4 * webhookBaseBackoff,
+    20: webhookMaxBackoff,
+  } {
+    if got := exponentialBackoff(webhookBaseBackoff, webhookMaxBackoff, attempts); want != got {
+      t.Errorf("backoff after %d attempts = %s, want %s", attempts, got, want)
+    }
+  }
+}
+
+func TestWebhookDeliverDeadLetter(t *testing.T) {
+  var received atomic.Int32
+
+  receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    received.Add(1)
+    w.WriteHeader(http.StatusBadGateway)
+  }))
+
+  defer receiver.Close()
+
+  service, db := newWebhookTest(t, receiver.URL)
+
+  for i := 0; i < webhookMaxAttempts; i++ {
+    // Skip the backoff so that every run finds the delivery due.
+    if _, err := db.Exec(`UPDATE webhook_delivery SET next_attempt_at = '2000-01-01 00:00:00';`); nil != err {
+      t.Fatal(err)
+    }
+
+    if err := service.Deliver(context.Background()); nil != err {
+      t.Fatal(err)
+    }
+  }
+
+  delivery := getTestWebhookDelivery(t, db)
+  if WebhookDeliveryDead != delivery.status || webhookMaxAttempts != delivery.attempts {
+    t.Fatalf("delivery = %+v, want dead after %d attempts", delivery, webhookMaxAttempts)
+  }
+
+  // Dead deliveries stay out of the queue.
+  if _, err := db.Exec(`UPDATE webhook_delivery SET next_attempt_at = '2000-01-01 00:00:00';`); nil != err {
+    t.Fatal(err)
+  }
+
+  if err := service.Deliver(context.Background()); nil != err {
+    t.Fatal(err)
+  }
+
+  if webhookMaxAttempts != int(received.Load()) {
+    t.Fatalf("receiver got %d requests, want %d", received.Load(), webhookMaxAttempts)
+  }
+}
+
+func TestIsPublicIP(t *testing.T) {
+  for address, want := range map[string]bool{
+    "93.184.216.34":        true,
+    "2606:2800:220:1::":    true,
+    "100.63.255.255":       true,
+    "127.0.0.1":            false,
+    "10.1.2.3":             false,
+    "169.254.169.254":      false,
+    "0.0.0.0":              false,
+    "0.1.2.3":              false,
+    "100.64.0.1":           false,
+    "100.127.255.255":      false,
+    "::1":                  false,
+    "fd00::1":              false,
+    "::ffff:127.0.0.1":     false,
+    "::ffff:100.100.100.1": false,
+  } {
+    if got := isPublicIP(net.ParseIP(address)); want != got {
+      t.Errorf("isPublicIP(%s) = %t, want %t", address, got, want)
+    }
+  }
+}